@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+
+	lndir "github.com/launchdarkly/go-lndir"
+)
+
+// event is a line of -format=json output.  Source paths are written as they would appear in a link.
+// Layer is only set for link events when there are several sources, so that the first one, 0, is
+// not confused with a missing layer.
+type event struct {
+	Event    string     `json:"event"`
+	Source   string     `json:"source,omitempty"`
+	Target   string     `json:"target,omitempty"`
+	Text     string     `json:"text,omitempty"`
+	Expected string     `json:"expected,omitempty"`
+	Mode     lndir.Mode `json:"mode,omitempty"`
+	Layer    *int       `json:"layer,omitempty"`
+	Reason   string     `json:"reason,omitempty"`
+	Op       string     `json:"op,omitempty"`
+	Message  string     `json:"message,omitempty"`
+}
+
+// summary is the last line of -format=json output for each run or update.
+type summary struct {
+	Event              string `json:"event"`
+	DryRun             bool   `json:"dry_run,omitempty"`
+	CreatedDirectories int    `json:"dirs_created"`
+	CreatedLinks       int    `json:"links_created"`
+	ExistingLinks      int    `json:"links_existing"`
+	MismatchedLinks    int    `json:"links_mismatched"`
+	Conflicts          int    `json:"conflicts"`
+	Replaced           int    `json:"replaced"`
+	RemovedLinks       int    `json:"links_removed"`
+	RemovedDirectories int    `json:"dirs_removed"`
+	Skipped            int    `json:"skipped"`
+	Errors             int    `json:"errors"`
+}
+
+// eventWriter writes -format=json output, one JSON object per line, as Lndir reports each entry
+// through the hooks in Config, which are called in the same order whatever the concurrency.
+type eventWriter struct {
+	encoder *json.Encoder
+	// overlay is set when there are several sources, in which case link events include the layer
+	overlay bool
+}
+
+func newEventWriter(w io.Writer, overlay bool) *eventWriter {
+	return &eventWriter{encoder: json.NewEncoder(w), overlay: overlay}
+}
+
+// observe sets the hooks in config to write events.
+func (w *eventWriter) observe(config *lndir.Config) {
+	config.OnEvent = func(e lndir.Event) { w.write(w.entryEvent(e)) }
+	config.OnSkip = func(entry lndir.SkippedEntry) {
+		w.write(event{Event: "skipped", Source: entry.Path, Reason: string(entry.Reason)})
+	}
+	config.OnError = func(err error) { w.write(errorEvent(err)) }
+}
+
+// write encodes v as a line of output.
+func (w *eventWriter) write(v interface{}) {
+	w.encoder.Encode(v)
+}
+
+// writeSummary writes the summary of a run or update.  err is the error that stopped the run, if any,
+// which is written first since it was not reported through the hooks.
+func (w *eventWriter) writeSummary(result *lndir.Result, err error, dryRun bool) {
+	if result == nil {
+		result = &lndir.Result{}
+	}
+	errorCount := len(result.Errors)
+	// With -collecterrors, err repeats the errors reported already
+	if _, collected := err.(lndir.EntryErrors); err != nil && !collected {
+		w.write(errorEvent(err))
+		errorCount++
+	}
+
+	w.write(summary{
+		Event:              "summary",
+		DryRun:             dryRun,
+		CreatedDirectories: len(result.CreatedDirectories),
+		CreatedLinks:       len(result.CreatedLinks),
+		ExistingLinks:      len(result.ExistingLinks),
+		MismatchedLinks:    len(result.MismatchedLinks),
+		Conflicts:          len(result.Conflicts),
+		Replaced:           len(result.Replaced),
+		RemovedLinks:       len(result.RemovedLinks),
+		RemovedDirectories: len(result.RemovedDirectories),
+		Skipped:            len(result.Skipped),
+		Errors:             errorCount,
+	})
+}
+
+func (w *eventWriter) entryEvent(e lndir.Event) event {
+	out := event{Event: string(e.Kind), Source: e.Source, Target: e.Target, Text: e.Link.Text, Mode: e.Link.Mode, Expected: e.Expected, Reason: string(e.Reason)}
+	if w.overlay && e.Link.Path != "" {
+		layer := e.Link.Layer
+		out.Layer = &layer
+	}
+	return out
+}
+
+func errorEvent(err error) event {
+	var pathErr *lndir.PathError
+	if errors.As(err, &pathErr) {
+		return event{Event: "error", Source: pathErr.Source, Target: pathErr.Target, Op: pathErr.Op, Message: pathErr.Err.Error()}
+	}
+	return event{Event: "error", Message: err.Error()}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	lndir "github.com/launchdarkly/go-lndir"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventsMatchSequentialRun(t *testing.T) {
+	source, err := ioutil.TempDir("", "lndir-test")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer os.RemoveAll(source)
+	for i := 0; i < 5; i++ {
+		for j := 0; j < 5; j++ {
+			for _, name := range []string{fmt.Sprintf("dir%d/sub%d/file", i, j), fmt.Sprintf("dir%d/file%d", i, j), fmt.Sprintf("dir%d/file%d~", i, j)} {
+				assert.NoError(t, os.MkdirAll(filepath.Join(source, filepath.Dir(name)), 0777))
+				assert.NoError(t, ioutil.WriteFile(filepath.Join(source, name), nil, 0666))
+			}
+		}
+	}
+
+	run := func(concurrency int) string {
+		target, err := ioutil.TempDir("", "lndir-test")
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		defer os.RemoveAll(target)
+		// Conflicts
+		assert.NoError(t, os.MkdirAll(filepath.Join(target, "dir2", "sub3", "file"), 0777))
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(target, "dir4"), nil, 0666))
+
+		var output bytes.Buffer
+		events := newEventWriter(&output, false)
+		config := lndir.Config{Silent: true, Concurrency: concurrency, Logger: discardLogger{}}
+		events.observe(&config)
+		result, err := lndir.LndirContext(context.Background(), source, target, config)
+		events.writeSummary(result, err, false)
+		return strings.Replace(output.String(), target, "TARGET", -1)
+	}
+
+	sequential := run(1)
+	assert.Contains(t, sequential, `"event":"conflict"`)
+	assert.Contains(t, sequential, `"event":"skipped"`)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, sequential, run(4))
+	}
+}
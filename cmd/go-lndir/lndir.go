@@ -29,38 +29,136 @@ in this Software without prior written authorization from The Open Group.
 */
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	lndir "github.com/launchdarkly/go-lndir"
 )
 
 func main() {
-	config := lndir.Config{}
+	args := os.Args[1:]
+	command := ""
+	if len(args) > 0 && (args[0] == "unlink" || args[0] == "verify") {
+		command, args = args[0], args[1:]
+	}
+
+	config := lndir.Config{
+		RevInfoNames: append([]string{}, lndir.DefaultRevInfoNames...),
+		JunkNames:    append([]string{}, lndir.DefaultJunkNames...),
+		OSJunkNames:  append([]string{}, lndir.DefaultOSJunkNames...),
+	}
 
-	flag.BoolVar(&config.Silent, "silent", false, "suppress output")
-	flag.BoolVar(&config.IgnoreLinks, "ignorelinks", false, "Don't give links special treatment")
-	flag.BoolVar(&config.WithRevInfo, "withrevinfo", false, "Include revision directories (.git, etc)")
-	flag.BoolVar(&config.UseGitignore, "gitignore", false, "Exclude files listed in ,gitignore files")
+	flags := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s [unlink|verify] [options] <source directory> [target directory]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.BoolVar(&config.Silent, "silent", false, "suppress output")
+	flags.BoolVar(&config.IgnoreLinks, "ignorelinks", false, "Don't give links special treatment")
+	flags.BoolVar(&config.WithRevInfo, "withrevinfo", false, "Include revision directories (.git, etc)")
+	flags.Var((*nameList)(&config.RevInfoNames), "revinfo", "Add a revision control directory name, which may be a glob, to those skipped, or clear them if empty (repeatable)")
+	flags.Var((*nameList)(&config.JunkNames), "junk", "Add a glob for backup or editor files to those skipped, or clear them if empty (repeatable)")
+	flags.Var((*nameList)(&config.OSJunkNames), "osjunkname", "Add a glob for files left by file managers to those skipped by -osjunk, or clear them if empty (repeatable)")
+	flags.Var(&config.OSJunk, "osjunk", "When to skip files left by file managers, such as .DS_Store: auto (on macOS), always or never")
+	flags.BoolVar(&config.UseGitignore, "gitignore", false, "Exclude files listed in ,gitignore files")
+	flags.BoolVar(&config.UseGitInfoExclude, "gitinfoexclude", false, "Exclude files listed in the source's .git/info/exclude")
+	flags.BoolVar(&config.UseGlobalGitignore, "globalgitignore", false, "Exclude files listed in git's core.excludesFile (by default $XDG_CONFIG_HOME/git/ignore)")
+	flags.BoolVar(&config.GitTracked, "gittracked", false, "Only link files in the source's git index")
+	flags.BoolVar(&config.IncludeUntracked, "untracked", false, "With -gittracked, also link untracked files that git does not ignore")
+	flags.BoolVar(&config.GitHead, "githead", false, "With -gittracked, use the files in the commit that is checked out instead of those in the index")
+	flags.Var(&config.Mode, "mode", "How to reproduce files: symlink, hardlink, copy, reflink (falling back to copy) or staged (writing files whose staged contents differ)")
+	flags.BoolVar(&config.Fold, "fold", false, "Link whole directories when nothing in them is excluded and the target has no such directory")
+	flags.BoolVar(&config.DryRun, "n", false, "Print the changes that would be made without making them")
+	flags.BoolVar(&config.Prune, "prune", false, "Remove dangling or excluded links to the source and directories left empty")
+	flags.Var(&config.OnConflict, "conflict", "What to do with existing files and links that are in the way: skip, replace, backup or error")
+	flags.StringVar(&config.BackupSuffix, "suffix", lndir.DefaultBackupSuffix, "Suffix appended to backups made by -conflict=backup")
+	flags.IntVar(&config.Concurrency, "j", 1, "Number of directories to process concurrently")
+	flags.BoolVar(&config.FailFast, "failfast", false, "Stop at the first file or directory that cannot be linked")
+	flags.BoolVar(&config.CollectErrors, "collecterrors", false, "Exit with an error if any file or directory could not be linked")
+	flags.Var(excludeFlag{&config, ""}, "exclude", "Don't link files matching a gitignore-style pattern relative to the source (repeatable)")
+	flags.Var(excludeFlag{&config, "!"}, "include", "Link files matching a gitignore-style pattern even if an earlier -exclude matched them (repeatable)")
+	flags.StringVar(&config.IgnoreFile, "ignorefile", lndir.DefaultIgnoreFile, "Name of the files listing gitignore-style patterns for entries not to link, or empty to read none")
+	flags.BoolVar(&config.LinkIgnoreFiles, "linkignorefiles", false, "Link the files named by -ignorefile themselves")
+	var overlays stringList
+	flags.Var(&overlays, "overlay", "Another source directory to merge into the target, overriding earlier ones (repeatable)")
+	watch := flags.Bool("watch", false, "Keep the target in sync with changes to the source until interrupted")
+	format := flags.String("format", "text", "Output format: text, or json for one JSON object per line for each change, skipped entry and error, followed by a summary")
 
-	flag.Parse()
+	flags.Parse(args)
+	config.NoIgnoreFile = config.IgnoreFile == ""
 
-	if flag.NArg() < 1 && flag.NArg() > 2 {
-		flag.Usage()
+	jsonOutput := *format == "json"
+	if flags.NArg() < 1 || flags.NArg() > 2 || (command != "" && (len(overlays) > 0 || *watch)) || (*watch && (len(overlays) > 0 || config.DryRun)) ||
+		(*format != "text" && !jsonOutput) || (jsonOutput && command == "verify") {
+		flags.Usage()
 		os.Exit(1)
 	}
 
-	fromPath := flag.Arg(0)
-	toPath := flag.Arg(1)
+	fromPath := flags.Arg(0)
+	toPath := flags.Arg(1)
 	if toPath == "" {
 		toPath = "."
 	}
 
-	err := lndir.Lndir(fromPath, toPath, config)
+	var events *eventWriter
+	if jsonOutput {
+		// Everything is reported as events instead
+		config.Silent = true
+		config.Logger = log.New(ioutil.Discard, "", 0)
+		events = newEventWriter(os.Stdout, len(overlays) > 0)
+		events.observe(&config)
+	}
+
+	var result *lndir.Result
+	var err error
+	switch command {
+	case "verify":
+		os.Exit(verify(fromPath, toPath, config))
+	case "unlink":
+		result, err = lndir.Unlndir(fromPath, toPath, config)
+		if !config.Silent && !jsonOutput {
+			for _, kept := range result.Kept {
+				fmt.Printf("kept %s\n", kept)
+			}
+		}
+	default:
+		// Stop cleanly between entries when interrupted
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		if *watch {
+			watcher := lndir.NewWatcher(fromPath, toPath, config)
+			if jsonOutput {
+				watcher.OnSync = func(result *lndir.Result) { events.writeSummary(result, nil, false) }
+			}
+			err = watcher.Run(ctx)
+		} else if len(overlays) > 0 {
+			result, err = lndir.LndirMulti(ctx, append([]string{fromPath}, overlays...), toPath, config)
+		} else {
+			result, err = lndir.LndirContext(ctx, fromPath, toPath, config)
+		}
+	}
+
+	if jsonOutput {
+		if !*watch || err != nil {
+			events.writeSummary(result, err, config.DryRun)
+		}
+	} else if config.DryRun {
+		printOperations(os.Stdout, result)
+	}
 
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
+		if !jsonOutput {
+			fmt.Fprintln(os.Stderr, err)
+		}
 		if lndir.IsUserError(err) {
 			os.Exit(2)
 		} else {
@@ -68,3 +166,128 @@ func main() {
 		}
 	}
 }
+
+// stringList is a flag.Value for flags that may be given more than once
+type stringList []string
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+func (s *stringList) String() string {
+	return fmt.Sprint([]string(*s))
+}
+
+// nameList is a flag.Value for flags that add to a list with defaults, where an empty value clears
+// the list
+type nameList []string
+
+func (n *nameList) Set(value string) error {
+	if value == "" {
+		*n = []string{}
+	} else {
+		*n = append(*n, value)
+	}
+	return nil
+}
+
+func (n *nameList) String() string {
+	if n == nil {
+		return ""
+	}
+	return strings.Join(*n, ",")
+}
+
+// excludeFlag is a flag.Value for -exclude and -include, which share Config.Exclude so that later
+// patterns override earlier ones regardless of which flag gave them
+type excludeFlag struct {
+	config *lndir.Config
+	prefix string
+}
+
+func (e excludeFlag) Set(value string) error {
+	e.config.Exclude = append(e.config.Exclude, e.prefix+value)
+	return nil
+}
+
+func (e excludeFlag) String() string {
+	return ""
+}
+
+// Exit codes for verify, in addition to the usual 1 and 2 for errors
+const (
+	exitClean   = 0
+	exitDrifted = 3
+)
+
+func verify(fromPath, toPath string, config lndir.Config) int {
+	drift, err := lndir.Verify(fromPath, toPath, config)
+
+	for _, link := range drift.MissingLinks {
+		fmt.Printf("missing link: %s -> %s\n", link.Path, link.Text)
+	}
+	for _, dir := range drift.MissingDirectories {
+		fmt.Printf("missing directory: %s\n", dir)
+	}
+	for _, link := range drift.MismatchedLinks {
+		fmt.Printf("mismatched link: %s -> %s (expected %s)\n", link.Path, link.Text, link.Expected)
+	}
+	for _, link := range drift.StaleLinks {
+		fmt.Printf("stale link: %s\n", link)
+	}
+	for _, file := range drift.ExtraFiles {
+		fmt.Printf("extra file: %s\n", file)
+	}
+	for _, conflict := range drift.Conflicts {
+		fmt.Printf("conflict: %s %s\n", conflict.Path, conflict.Reason)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		if lndir.IsUserError(err) {
+			return 2
+		}
+		return 1
+	}
+	if len(drift.Errors) > 0 {
+		return 1
+	}
+	if !drift.IsClean() {
+		return exitDrifted
+	}
+	return exitClean
+}
+
+func printOperations(w io.Writer, result *lndir.Result) {
+	for _, link := range result.Unfolded {
+		fmt.Fprintf(w, "rm %s\n", link)
+	}
+	for _, dir := range result.CreatedDirectories {
+		fmt.Fprintf(w, "mkdir %s\n", dir)
+	}
+	for _, link := range result.CreatedLinks {
+		switch link.Mode {
+		case lndir.ModeHardlink:
+			fmt.Fprintf(w, "ln %s %s\n", link.Text, link.Path)
+		case lndir.ModeCopy:
+			fmt.Fprintf(w, "cp -p %s %s\n", link.Text, link.Path)
+		case lndir.ModeReflink:
+			fmt.Fprintf(w, "cp -p --reflink=auto %s %s\n", link.Text, link.Path)
+		case lndir.ModeStaged:
+			fmt.Fprintf(w, "git cat-file blob %s > %s\n", link.Text, link.Path)
+		default:
+			fmt.Fprintf(w, "ln -s %s %s\n", link.Text, link.Path)
+		}
+	}
+	for _, link := range result.RemovedLinks {
+		fmt.Fprintf(w, "rm %s\n", link)
+	}
+	for _, dir := range result.RemovedDirectories {
+		fmt.Fprintf(w, "rmdir %s\n", dir)
+	}
+	// Conflicts are not operations, so they are written as comments
+	for _, conflict := range result.Conflicts {
+		fmt.Fprintf(w, "# conflict: %s %s\n", conflict.Path, conflict.Reason)
+	}
+}
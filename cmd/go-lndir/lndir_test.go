@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	lndir "github.com/launchdarkly/go-lndir"
+	"github.com/stretchr/testify/assert"
+)
+
+type discardLogger struct{}
+
+func (discardLogger) Printf(format string, v ...interface{}) {}
+func (discardLogger) Println(v ...interface{})               {}
+
+func TestPrintOperationsListsConflicts(t *testing.T) {
+	source, err := ioutil.TempDir("", "lndir-test")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer os.RemoveAll(source)
+	target, err := ioutil.TempDir("", "lndir-test")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer os.RemoveAll(target)
+	for _, name := range []string{"a", "b"} {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(source, name), nil, 0666))
+	}
+	assert.NoError(t, os.Mkdir(filepath.Join(target, "b"), 0777))
+
+	result, err := lndir.LndirContext(context.Background(), source, target, lndir.Config{Silent: true, DryRun: true, Logger: discardLogger{}})
+	assert.NoError(t, err)
+	var output bytes.Buffer
+	printOperations(&output, result)
+	assert.Equal(t, "ln -s "+filepath.Join(source, "a")+" "+filepath.Join(target, "a")+"\n"+
+		"# conflict: "+filepath.Join(target, "b")+" is a directory instead of a link\n", output.String())
+	_, err = os.Lstat(filepath.Join(target, "a"))
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,115 @@
+package lndir
+
+import (
+	"fmt"
+	"os"
+)
+
+// ConflictPolicy determines what Lndir does when an existing entry in the target tree is in the way
+// of a link or directory, including links that point somewhere other than expected.
+type ConflictPolicy string
+
+const (
+	// ConflictPolicySkip reports the conflict and leaves the existing entry alone.  This is the default.
+	ConflictPolicySkip ConflictPolicy = "skip"
+	// ConflictPolicyReplace replaces existing links and files.  Links are replaced atomically.
+	// Directories are never replaced.
+	ConflictPolicyReplace ConflictPolicy = "replace"
+	// ConflictPolicyBackup renames the existing entry by appending Config.BackupSuffix to its name.
+	// Existing backups are kept: if the name is taken, a number is inserted before the suffix, as
+	// in "name.1~", "name.2~" and so on.
+	ConflictPolicyBackup ConflictPolicy = "backup"
+	// ConflictPolicyError stops Lndir with an error.
+	ConflictPolicyError ConflictPolicy = "error"
+)
+
+// DefaultBackupSuffix is used by ConflictPolicyBackup if Config.BackupSuffix is empty.  Since
+// DefaultJunkNames includes names ending in "~", backups are not linked if the target is later used as a source.
+const DefaultBackupSuffix = "~"
+
+// Set implements flag.Value.
+func (p *ConflictPolicy) Set(value string) error {
+	switch policy := ConflictPolicy(value); policy {
+	case ConflictPolicySkip, ConflictPolicyReplace, ConflictPolicyBackup, ConflictPolicyError:
+		*p = policy
+		return nil
+	}
+	return fmt.Errorf("unknown conflict policy %q", value)
+}
+
+func (p *ConflictPolicy) String() string {
+	if p == nil || *p == "" {
+		return string(ConflictPolicySkip)
+	}
+	return string(*p)
+}
+
+// makeRoom applies the conflict policy to the existing entry at targetPath.  It returns true if a
+// link or directory should now be created at targetPath.  With ConflictPolicyReplace, existing links
+// and files where links belong are left for replaceLink to replace.
+func (l *directoryLinker) makeRoom(targetPath string, reason ConflictReason) (bool, error) {
+	switch l.onConflict {
+	case ConflictPolicyError:
+		return false, &ConflictError{Conflict{Path: targetPath, Reason: reason}}
+	case ConflictPolicyReplace:
+		switch reason {
+		case ConflictDirectoryForLink:
+			return false, nil
+		case ConflictLinkForDirectory, ConflictFileForDirectory:
+			if !l.dryRun {
+				if err := os.Remove(targetPath); err != nil {
+					l.logError(targetPath, newPathError("", targetPath, err))
+					return false, nil
+				}
+			}
+		}
+	case ConflictPolicyBackup:
+		if !l.dryRun {
+			if err := os.Rename(targetPath, l.backupName(targetPath)); err != nil {
+				l.logError(targetPath, newPathError("", targetPath, err))
+				return false, nil
+			}
+		}
+	default:
+		return false, nil
+	}
+	l.record(Event{Kind: EventReplaced, Target: targetPath})
+	return true, nil
+}
+
+// backupName returns the first name for a backup of targetPath that is not taken.  The names are
+// checked before renaming, so two runs making backups of the same entry at once could still clash.
+func (l *directoryLinker) backupName(targetPath string) string {
+	name := targetPath + l.backupSuffix
+	for n := 1; ; n++ {
+		if _, err := os.Lstat(name); err != nil {
+			// Names that cannot be checked are left for the rename to report
+			return name
+		}
+		name = fmt.Sprintf("%s.%d%s", targetPath, n, l.backupSuffix)
+	}
+}
+
+// tmpSuffix is appended to the names of new entries that are renamed over existing ones, followed by
+// a random number
+const tmpSuffix = ".lndir-tmp"
+
+// maxTempTries limits the number of taken temporary names replaceWith tries before giving up
+const maxTempTries = 100
+
+// replaceLink creates a link at newname to oldname after makeRoom has dealt with whatever was
+// there.  Links and files are replaced atomically by renaming a new link over them.
+func (l *directoryLinker) replaceLink(oldname, newname string) error {
+	if l.onConflict != ConflictPolicyReplace {
+		return l.symlink(oldname, newname)
+	}
+	return l.swapLink(oldname, newname)
+}
+
+// swapLink atomically replaces whatever is at newname with a link to oldname.
+func (l *directoryLinker) swapLink(oldname, newname string) error {
+	if l.dryRun {
+		return nil
+	}
+	return replaceWith(newname, true, func(name string) error { return os.Symlink(oldname, name) })
+}
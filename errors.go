@@ -0,0 +1,132 @@
+package lndir
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	// ErrNotDirectory is returned, wrapped in a *PathError, when the source or target is not a directory.
+	ErrNotDirectory = errors.New("Not a directory")
+	// ErrSameDirectory is returned, wrapped in a *PathError, when the source and target are the same directory.
+	ErrSameDirectory = errors.New("From and to directories are identical!")
+	// ErrNotGitWorkTree is returned, wrapped in a *PathError, when Config.GitTracked is set but the source
+	// directory is not the top of a git working tree.
+	ErrNotGitWorkTree = errors.New("not the top of a git working tree")
+	// ErrUnsupportedGitIndex is returned, wrapped in a *PathError, when the git index uses an extension
+	// that changes how its entries are read, such as that of a split index or a sparse index.
+	ErrUnsupportedGitIndex = errors.New("unsupported git index extension")
+)
+
+// PathError records an error and the source and/or target path that caused it.  Source is written
+// as it would appear in a link.
+type PathError struct {
+	Op     string
+	Source string
+	Target string
+	Err    error
+}
+
+func (e *PathError) Error() string {
+	name := e.Source
+	if e.Target != "" {
+		if name != "" {
+			name += " "
+		}
+		name += e.Target
+	}
+	if e.Op != "" {
+		name = e.Op + " " + name
+	}
+	return name + ": " + e.Err.Error()
+}
+
+func (e *PathError) Unwrap() error {
+	return e.Err
+}
+
+// newPathError wraps err, taking the operation from err if it is one of the os package's error types
+// so that paths are not repeated in the message.
+func newPathError(source, target string, err error) *PathError {
+	switch osErr := err.(type) {
+	case *os.PathError:
+		return &PathError{Op: osErr.Op, Source: source, Target: target, Err: osErr.Err}
+	case *os.LinkError:
+		return &PathError{Op: osErr.Op, Source: source, Target: target, Err: osErr.Err}
+	case *os.SyscallError:
+		return &PathError{Op: osErr.Syscall, Source: source, Target: target, Err: osErr.Err}
+	}
+	return &PathError{Source: source, Target: target, Err: err}
+}
+
+// ConflictError is returned when ConflictPolicyError is in effect and an existing entry in the target
+// tree is in the way.
+type ConflictError struct {
+	Conflict
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Path, e.Reason)
+}
+
+// EntryErrors is returned when Config.CollectErrors is set and there were errors for individual
+// entries.  As in Result.Errors, each is or wraps a *PathError.
+type EntryErrors []error
+
+func (e EntryErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+func (e EntryErrors) Unwrap() []error {
+	return e
+}
+
+// failure records the first error for an individual entry when Config.FailFast is set, or the
+// conflict that aborts a concurrent walk, and cancels the walk.
+type failure struct {
+	mu     sync.Mutex
+	err    error
+	cancel context.CancelFunc
+}
+
+func (f *failure) set(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err == nil {
+		f.err = err
+		f.cancel()
+	}
+}
+
+func (f *failure) get() error {
+	if f == nil {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.err
+}
+
+// userError marks errors caused by the arguments rather than by the file system.
+type userError struct {
+	error
+}
+
+func (e userError) Unwrap() error {
+	return e.error
+}
+
+// IsUserError returns true if err was caused by invalid arguments, such as a source that is not a
+// directory.
+func IsUserError(err error) bool {
+	var userErr userError
+	return errors.As(err, &userErr)
+}
@@ -0,0 +1,133 @@
+package lndir
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrors(t *testing.T) {
+	source := makeTree(t, "file", "dir1/file")
+	defer os.RemoveAll(source)
+	target := makeTree(t)
+	defer os.RemoveAll(target)
+
+	t.Run("not a directory", func(t *testing.T) {
+		err := Lndir(filepath.Join(source, "file"), target, Config{Silent: true, Logger: discardLogger{}})
+		assert.True(t, errors.Is(err, ErrNotDirectory))
+		assert.True(t, IsUserError(err))
+		var pathErr *PathError
+		if assert.True(t, errors.As(err, &pathErr)) {
+			assert.Equal(t, filepath.Join(source, "file"), pathErr.Source)
+		}
+		assert.Equal(t, filepath.Join(source, "file")+": Not a directory", err.Error())
+	})
+
+	t.Run("same directory", func(t *testing.T) {
+		err := Lndir(source, source, Config{Silent: true, Logger: discardLogger{}})
+		assert.True(t, errors.Is(err, ErrSameDirectory))
+		assert.True(t, IsUserError(err))
+	})
+
+	t.Run("missing target", func(t *testing.T) {
+		err := Lndir(source, filepath.Join(target, "missing"), Config{Silent: true, Logger: discardLogger{}})
+		assert.True(t, errors.Is(err, os.ErrNotExist))
+		assert.False(t, IsUserError(err))
+	})
+
+	t.Run("entry errors", func(t *testing.T) {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(target, "dir1"), nil, 0666))
+
+		// Backing up dir1 fails because it is not a directory
+		result, err := LndirContext(context.Background(), source, target, Config{Silent: true, OnConflict: ConflictPolicyBackup, BackupSuffix: "/backup", Logger: discardLogger{}})
+		assert.NoError(t, err)
+		if assert.Len(t, result.Errors, 1) {
+			var pathErr *PathError
+			if assert.True(t, errors.As(result.Errors[0], &pathErr)) {
+				assert.Equal(t, "rename", pathErr.Op)
+				assert.Equal(t, filepath.Join(target, "dir1"), pathErr.Target)
+			}
+			assert.True(t, errors.Is(result.Errors[0], syscall.ENOTDIR))
+		}
+	})
+
+	t.Run("entry errors without a path", func(t *testing.T) {
+		failed := errors.New("failed")
+		result := &Result{}
+		linker := newDirectoryLinker(Config{Silent: true, Logger: discardLogger{}}, result)
+		linker.currentPath = path{"/", "source", "dir"}
+		linker.logError("", failed)
+		if assert.Len(t, result.Errors, 1) {
+			var pathErr *PathError
+			if assert.True(t, errors.As(result.Errors[0], &pathErr)) {
+				assert.Equal(t, "/source/dir", pathErr.Source)
+			}
+			assert.True(t, errors.Is(result.Errors[0], failed))
+		}
+	})
+}
+
+func TestEntryErrorModes(t *testing.T) {
+	source := makeTree(t, "a", "b", "c")
+	defer os.RemoveAll(source)
+
+	// Each entry fails because the backup suffix refers to a directory that does not exist
+	run := func(config Config) (*Result, error) {
+		target := makeTree(t, "a", "b", "c")
+		defer os.RemoveAll(target)
+		config.Silent, config.Logger = true, discardLogger{}
+		config.OnConflict, config.BackupSuffix = ConflictPolicyBackup, "/missing/backup"
+		return LndirContext(context.Background(), source, target, config)
+	}
+
+	t.Run("default", func(t *testing.T) {
+		result, err := run(Config{})
+		assert.NoError(t, err)
+		assert.Len(t, result.Errors, 3)
+	})
+
+	t.Run("collect errors", func(t *testing.T) {
+		result, err := run(Config{CollectErrors: true})
+		var entryErrors EntryErrors
+		if assert.True(t, errors.As(err, &entryErrors)) {
+			assert.Len(t, entryErrors, 3)
+		}
+		assert.True(t, errors.Is(err, syscall.ENOTDIR))
+		assert.Len(t, result.Errors, 3)
+	})
+
+	t.Run("fail fast", func(t *testing.T) {
+		result, err := run(Config{FailFast: true})
+		var pathErr *PathError
+		if assert.True(t, errors.As(err, &pathErr)) {
+			assert.Equal(t, "rename", pathErr.Op)
+		}
+		assert.Len(t, result.Errors, 1)
+	})
+}
+
+func TestConflictErrorStopsConcurrentWalk(t *testing.T) {
+	var files []string
+	for i := 0; i < 20; i++ {
+		for j := 0; j < 20; j++ {
+			files = append(files, fmt.Sprintf("dir%02d/file%02d", i, j))
+		}
+	}
+	source := makeTree(t, files...)
+	defer os.RemoveAll(source)
+	target := makeTree(t, "dir10")
+	defer os.RemoveAll(target)
+
+	_, err := LndirContext(context.Background(), source, target, Config{Silent: true, Concurrency: 4, OnConflict: ConflictPolicyError, Logger: discardLogger{}})
+	var conflictErr *ConflictError
+	if assert.True(t, errors.As(err, &conflictErr)) {
+		assert.Equal(t, filepath.Join(target, "dir10"), conflictErr.Path)
+	}
+}
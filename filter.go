@@ -0,0 +1,191 @@
+package lndir
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/src-d/go-git.v4/plumbing/format/gitignore"
+)
+
+// Filter decides which entries in the source tree are linked.
+type Filter interface {
+	// Skip returns true and a reason if the source entry at relPath, which is relative to the source
+	// directory, should not be linked.  info describes the entry itself rather than what it links to.
+	// Skipping a directory skips everything in it.
+	Skip(relPath []string, info os.FileInfo) (bool, SkipReason)
+}
+
+// FilterFunc adapts a function to the Filter interface.
+type FilterFunc func(relPath []string, info os.FileInfo) (bool, SkipReason)
+
+func (f FilterFunc) Skip(relPath []string, info os.FileInfo) (bool, SkipReason) {
+	return f(relPath, info)
+}
+
+// Filters skips entries skipped by any of its filters, with the reason given by the first of them.
+type Filters []Filter
+
+func (filters Filters) Skip(relPath []string, info os.FileInfo) (bool, SkipReason) {
+	for _, filter := range filters {
+		if filter == nil {
+			continue
+		}
+		if skip, reason := filter.Skip(relPath, info); skip {
+			return true, reason
+		}
+	}
+	return false, ""
+}
+
+// DefaultRevInfoNames lists the directories in which revision control systems keep their data.
+var DefaultRevInfoNames = []string{".git", ".hg", ".bzr", "_darcs", ".jj", ".pijul", ".svn", "BigKeeper", "BitKeeper", "RCS", "SCCS", "CVS", "CVS.adm"}
+
+// DefaultJunkNames lists patterns for the names of backup and editor swap files.
+var DefaultJunkNames = []string{"*~", "*.swp"}
+
+// DefaultOSJunkNames lists the files that the macOS Finder and Windows Explorer leave in directories.
+var DefaultOSJunkNames = []string{".DS_Store", "._.DS_Store", "Thumbs.db"}
+
+// OSJunkPolicy determines when files listed in Config.OSJunkNames are skipped.
+type OSJunkPolicy string
+
+const (
+	// OSJunkAuto skips them when running on macOS.  This is the default.
+	OSJunkAuto OSJunkPolicy = "auto"
+	// OSJunkAlways skips them everywhere, for instance when mirroring a tree that came from a Mac.
+	OSJunkAlways OSJunkPolicy = "always"
+	// OSJunkNever links them like any other file.
+	OSJunkNever OSJunkPolicy = "never"
+)
+
+// Set implements flag.Value.
+func (p *OSJunkPolicy) Set(value string) error {
+	switch policy := OSJunkPolicy(value); policy {
+	case OSJunkAuto, OSJunkAlways, OSJunkNever:
+		*p = policy
+		return nil
+	}
+	return fmt.Errorf("unknown OS junk policy %q", value)
+}
+
+func (p *OSJunkPolicy) String() string {
+	if p == nil || *p == "" {
+		return string(OSJunkAuto)
+	}
+	return string(*p)
+}
+
+// NewNameFilter returns a filter that skips entries whose names match any of the given patterns,
+// which use the syntax of filepath.Match, giving reason.  If dirsOnly is true, only directories are
+// skipped.
+func NewNameFilter(reason SkipReason, dirsOnly bool, patterns ...string) Filter {
+	return FilterFunc(func(relPath []string, info os.FileInfo) (bool, SkipReason) {
+		if dirsOnly && !isDir(info) {
+			return false, ""
+		}
+		name := relPath[len(relPath)-1]
+		for _, pattern := range patterns {
+			if matched, _ := filepath.Match(pattern, name); matched {
+				return true, reason
+			}
+		}
+		return false, ""
+	})
+}
+
+// JunkFilter skips backup and editor swap files listed in DefaultJunkNames.
+var JunkFilter = NewNameFilter(SkipBackup, false, DefaultJunkNames...)
+
+// OSJunkFilter skips the files listed in DefaultOSJunkNames, regardless of the OS.
+var OSJunkFilter = NewNameFilter(SkipOSJunk, false, DefaultOSJunkNames...)
+
+// RevInfoFilter skips the revision control directories listed in DefaultRevInfoNames.
+var RevInfoFilter = NewNameFilter(SkipRevInfo, true, DefaultRevInfoNames...)
+
+// DefaultFilter returns the filter used when Config.Filter is nil.  It skips the files in
+// config.JunkNames, the files in config.OSJunkNames according to config.OSJunk, and the directories
+// in config.RevInfoNames unless config.WithRevInfo is set.  A nil list means the corresponding
+// default list.
+func DefaultFilter(config Config) Filter {
+	filters := Filters{NewNameFilter(SkipBackup, false, orDefault(config.JunkNames, DefaultJunkNames)...)}
+	if config.OSJunk == OSJunkAlways || (isOSX && config.OSJunk != OSJunkNever) {
+		filters = append(filters, NewNameFilter(SkipOSJunk, false, orDefault(config.OSJunkNames, DefaultOSJunkNames)...))
+	}
+	if !config.WithRevInfo {
+		filters = append(filters, NewNameFilter(SkipRevInfo, true, orDefault(config.RevInfoNames, DefaultRevInfoNames)...))
+	}
+	return filters
+}
+
+func orDefault(names, defaults []string) []string {
+	if names == nil {
+		return defaults
+	}
+	return names
+}
+
+// NewGitignoreFilter returns a filter that skips entries matched by the .gitignore files in the
+// directory root and its subdirectories.  Each .gitignore file is read when an entry in its directory
+// is first checked, and one that cannot be read is treated as empty.
+func NewGitignoreFilter(root string) Filter {
+	return &gitFilter{ignored: newIgnoreFiles(root, ".gitignore", nil, SkipGitignore, true)}
+}
+
+// NewPatternFilter returns a filter that skips entries matched by the given gitignore-style patterns,
+// which are relative to the source directory.  Later patterns override earlier ones, so a pattern
+// starting with "!" links entries skipped by an earlier pattern.
+func NewPatternFilter(patterns ...string) Filter {
+	parsed := make([]gitignore.Pattern, 0, len(patterns))
+	for _, pattern := range patterns {
+		parsed = append(parsed, gitignore.ParsePattern(pattern, nil))
+	}
+	matcher := gitignore.NewMatcher(parsed)
+	return FilterFunc(func(relPath []string, info os.FileInfo) (bool, SkipReason) {
+		return matcher.Match(relPath, isDir(info)), SkipExcluded
+	})
+}
+
+// gitFilter implements Config.UseGitignore and the related options.
+type gitFilter struct {
+	// ignored holds the gitignore patterns, if any
+	ignored *ignoreFiles
+	// tracked is set for Config.GitTracked, in which case tracked entries are never skipped and
+	// untracked ones are skipped unless includeUntracked is true
+	tracked          *trackedSet
+	includeUntracked bool
+	// skipUnmerged is set for ModeStaged, which has nothing to write for unmerged files
+	skipUnmerged bool
+}
+
+func (g *gitFilter) Skip(relPath []string, info os.FileInfo) (bool, SkipReason) {
+	if g.tracked != nil {
+		if g.skipUnmerged && !isDir(info) && g.tracked.unmerged[strings.Join(relPath, "/")] {
+			return true, SkipUnmerged
+		}
+		if g.tracked.isTracked(relPath, isDir(info)) {
+			return false, ""
+		}
+		if !g.includeUntracked {
+			return true, SkipUntracked
+		}
+	}
+	if g.ignored == nil {
+		return false, ""
+	}
+	return g.ignored.Skip(relPath, info)
+}
+
+// ignoredFiles returns the gitignore patterns, if g is not nil.
+func (g *gitFilter) ignoredFiles() *ignoreFiles {
+	if g == nil {
+		return nil
+	}
+	return g.ignored
+}
+
+// isDir is info.IsDir(), except that info may be nil for entries known not to be directories.
+func isDir(info os.FileInfo) bool {
+	return info != nil && info.IsDir()
+}
@@ -0,0 +1,129 @@
+package lndir
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// foldCache remembers which source directories can be folded during a walk, so that each directory
+// is only scanned once however many of the directories above it cannot be folded.
+type foldCache struct {
+	mu       sync.Mutex
+	foldable map[string]bool
+}
+
+func newFoldCache() *foldCache {
+	return &foldCache{foldable: map[string]bool{}}
+}
+
+func (c *foldCache) get(sourceName string) (foldable, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	foldable, ok = c.foldable[sourceName]
+	return
+}
+
+func (c *foldCache) set(sourceName string, foldable bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.foldable[sourceName] = foldable
+}
+
+// shouldFold returns true if the source subdirectory at sourcePath, named sourceName, can be linked
+// as a whole instead of being recreated in the target.  That is only the case if nothing below it
+// would be skipped, it contains no links, which would be rewritten if they were linked
+// individually, and no other source of an overlay has the same directory.  Nothing is folded when
+// Config.OnDir or Config.OnLink is set, since they could not be called for the entries inside.
+func (l *directoryLinker) shouldFold(sourcePath path, sourceName, targetPath string, baseDepth int) bool {
+	if !l.fold || l.mode != ModeSymlink || l.onDir != nil || l.onLink != nil || l.overlay.isShared(l.layer, targetPath) {
+		return false
+	}
+	if foldable, ok := l.foldCache.get(sourceName); ok {
+		return foldable
+	}
+	foldable := l.scanFoldable(sourcePath, sourceName, targetPath, baseDepth)
+	l.foldCache.set(sourceName, foldable)
+	return foldable
+}
+
+// scanFoldable checks the entries of the source directory for shouldFold.
+func (l *directoryLinker) scanFoldable(sourcePath path, sourceName, targetPath string, baseDepth int) bool {
+	f, err := os.Open(sourceName)
+	if err != nil {
+		return false
+	}
+	children, err := f.Readdirnames(0)
+	f.Close()
+	if err != nil {
+		return false
+	}
+
+	for _, name := range children {
+		childPath := append(sourcePath[:len(sourcePath):len(sourcePath)], name)
+		childName := join(sourceName, name)
+		info, err := os.Lstat(childName)
+		if err != nil || (info.Mode()&os.ModeSymlink != 0 && !l.ignoreLinks) {
+			return false
+		}
+		if l.skipReason(childPath, info, baseDepth) != "" {
+			return false
+		}
+		if info.IsDir() && !l.shouldFold(childPath, childName, join(targetPath, name), baseDepth) {
+			return false
+		}
+	}
+	return true
+}
+
+// foldDirectory creates a link at targetPath to the whole source subdirectory at sourcePath.
+func (l *directoryLinker) foldDirectory(subdirName string, sourcePath path, targetPath string) {
+	if err := l.symlink(sourcePath.String(), targetPath); err != nil {
+		l.logError(subdirName, newPathError(sourcePath.String(), targetPath, err))
+		return
+	}
+	l.record(Event{Kind: EventLinkCreated, Source: sourcePath.String(), Link: Link{Path: targetPath, Text: sourcePath.String(), Layer: l.layer}})
+}
+
+// isFolded returns true if targetInfo describes a link created by foldDirectory for the source
+// subdirectory at sourcePath, or for the same directory in another source of an overlay.
+func (l *directoryLinker) isFolded(targetPath string, targetInfo os.FileInfo, sourcePath path) bool {
+	if targetInfo.Mode()&os.ModeSymlink == 0 {
+		return false
+	}
+	existing := readlink(targetPath)
+	return existing != nil && equivalent(existing, sourcePath) || l.overlay.linksToOtherSource(l.layer, targetPath)
+}
+
+// unfold removes the link to a folded directory so that a real directory can be created in its
+// place.  In a dry run, the link is left alone and entries below it are treated as missing until
+// processing of the directory is finished.  It returns false if the link could not be removed.
+func (l *directoryLinker) unfold(subdirName string, sourcePath path, targetPath string) bool {
+	if l.dryRun {
+		l.unfolding = targetPath
+	} else if err := os.Remove(targetPath); err != nil {
+		l.logError(subdirName, newPathError(sourcePath.String(), targetPath, err))
+		return false
+	}
+	l.record(Event{Kind: EventLinkUnfolded, Target: targetPath})
+	return true
+}
+
+// lstatTarget is os.Lstat for entries in the target tree.  Entries below a folded directory being
+// unfolded in a dry run do not exist, since the directory would be empty when created.
+func (l *directoryLinker) lstatTarget(name string) (os.FileInfo, error) {
+	if l.unfolding != "" && strings.HasPrefix(name, l.unfolding+string(filepath.Separator)) {
+		return nil, &os.PathError{Op: "lstat", Path: name, Err: os.ErrNotExist}
+	}
+	return os.Lstat(name)
+}
+
+// readlinkTarget is readlink for entries in the target tree, with the same treatment of folded
+// directories as lstatTarget.
+func (l *directoryLinker) readlinkTarget(name string) path {
+	if info, err := l.lstatTarget(name); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		return nil
+	}
+	return readlink(name)
+}
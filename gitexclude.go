@@ -0,0 +1,196 @@
+package lndir
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/src-d/go-git.v4/plumbing/format/gitignore"
+)
+
+// readExcludePatterns reads the patterns that git applies to the repository at root in addition to
+// its .gitignore files: those in the repository's info/exclude file if infoExclude is true, and those
+// in the user's global excludes file if global is true.  The result is in ascending order of
+// priority, so the .gitignore patterns should be appended to it.
+func readExcludePatterns(root string, infoExclude, global bool) ([]gitignore.Pattern, error) {
+	gitDir := findGitDir(root)
+	var patterns []gitignore.Pattern
+	if global {
+		if name := globalExcludesFile(gitDir); name != "" {
+			ps, err := readPatternFile(name, nil)
+			if err != nil {
+				return nil, err
+			}
+			patterns = append(patterns, ps...)
+		}
+	}
+	if infoExclude && gitDir != "" {
+		ps, err := readPatternFile(filepath.Join(commonGitDir(gitDir), "info", "exclude"), nil)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, ps...)
+	}
+	return patterns, nil
+}
+
+// readPatternFile reads the patterns in a file that applies to the directory domain, which is nil for
+// the whole repository.  A missing file has no patterns.
+func readPatternFile(name string, domain []string) ([]gitignore.Pattern, error) {
+	data, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var patterns []gitignore.Pattern
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(line, "#") && len(strings.TrimSpace(line)) > 0 {
+			patterns = append(patterns, gitignore.ParsePattern(line, domain))
+		}
+	}
+	return patterns, nil
+}
+
+// findGitDir returns the git directory of the repository whose working tree is root, or "" if root
+// is not the top of a working tree.  The .git entry may be a file naming the git directory, as it is
+// for linked worktrees and submodules.
+func findGitDir(root string) string {
+	dotGit := filepath.Join(root, ".git")
+	info, err := os.Stat(dotGit)
+	if err != nil {
+		return ""
+	}
+	if info.IsDir() {
+		return dotGit
+	}
+	data, err := ioutil.ReadFile(dotGit)
+	if err != nil {
+		return ""
+	}
+	gitDir := strings.TrimSpace(strings.TrimPrefix(string(data), "gitdir:"))
+	if !filepath.IsAbs(gitDir) {
+		gitDir = filepath.Join(root, gitDir)
+	}
+	return gitDir
+}
+
+// commonGitDir returns the directory shared by all the worktrees of the repository with git directory
+// gitDir, which holds info/exclude.
+func commonGitDir(gitDir string) string {
+	data, err := ioutil.ReadFile(filepath.Join(gitDir, "commondir"))
+	if err != nil {
+		return gitDir
+	}
+	commonDir := strings.TrimSpace(string(data))
+	if !filepath.IsAbs(commonDir) {
+		commonDir = filepath.Join(gitDir, commonDir)
+	}
+	return commonDir
+}
+
+// globalExcludesFile returns the name of the file configured with core.excludesFile, or the default
+// of $XDG_CONFIG_HOME/git/ignore.  Configuration files are read in the same order as git, so the
+// repository's own configuration takes precedence if gitDir is not empty.
+func globalExcludesFile(gitDir string) string {
+	home, _ := os.UserHomeDir()
+	xdgConfigHome := os.Getenv("XDG_CONFIG_HOME")
+	if xdgConfigHome == "" && home != "" {
+		xdgConfigHome = filepath.Join(home, ".config")
+	}
+
+	configFiles := []string{"/etc/gitconfig"}
+	if xdgConfigHome != "" {
+		configFiles = append(configFiles, filepath.Join(xdgConfigHome, "git", "config"))
+	}
+	if home != "" {
+		configFiles = append(configFiles, filepath.Join(home, ".gitconfig"))
+	}
+	if gitDir != "" {
+		configFiles = append(configFiles, filepath.Join(commonGitDir(gitDir), "config"))
+	}
+
+	excludesFile := ""
+	for _, name := range configFiles {
+		if value, ok := readConfigValue(name, "core", "excludesfile"); ok {
+			excludesFile = value
+		}
+	}
+	if excludesFile == "" {
+		if xdgConfigHome == "" {
+			return ""
+		}
+		return filepath.Join(xdgConfigHome, "git", "ignore")
+	}
+	if strings.HasPrefix(excludesFile, "~/") && home != "" {
+		excludesFile = filepath.Join(home, excludesFile[2:])
+	}
+	return excludesFile
+}
+
+// readConfigValue returns the last value of key in section of the git configuration file name.
+// Section and key names must be given in lower case.  Includes and subsections are not supported.
+func readConfigValue(name, section, key string) (string, bool) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+
+	value, found := "", false
+	currentSection := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' {
+			if end := strings.IndexByte(line, ']'); end > 0 {
+				currentSection = strings.ToLower(strings.TrimSpace(line[1:end]))
+				line = strings.TrimSpace(line[end+1:])
+			}
+			if line == "" {
+				continue
+			}
+		}
+		if currentSection != section {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if strings.ToLower(strings.TrimSpace(parts[0])) != key || len(parts) < 2 {
+			continue
+		}
+		value, found = parseConfigValue(parts[1]), true
+	}
+	return value, found
+}
+
+// parseConfigValue removes quotes, escapes and trailing comments from a git configuration value.
+func parseConfigValue(raw string) string {
+	var value strings.Builder
+	quoted := false
+	for i := 0; i < len(raw); i++ {
+		switch c := raw[i]; {
+		case c == '"':
+			quoted = !quoted
+		case c == '\\' && i+1 < len(raw):
+			i++
+			switch raw[i] {
+			case 'n':
+				value.WriteByte('\n')
+			case 't':
+				value.WriteByte('\t')
+			default:
+				value.WriteByte(raw[i])
+			}
+		case (c == '#' || c == ';') && !quoted:
+			return strings.TrimSpace(value.String())
+		default:
+			value.WriteByte(c)
+		}
+	}
+	return strings.TrimSpace(value.String())
+}
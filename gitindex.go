@@ -0,0 +1,211 @@
+package lndir
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/index"
+)
+
+// readIndex reads the entries of the index in gitDir.
+func readIndex(gitDir string) ([]*index.Entry, error) {
+	data, err := ioutil.ReadFile(filepath.Join(gitDir, "index"))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < sha1.Size {
+		return nil, index.ErrInvalidChecksum
+	}
+	if sum := sha1.Sum(data[:len(data)-sha1.Size]); !bytes.Equal(sum[:], data[len(data)-sha1.Size:]) {
+		return nil, index.ErrInvalidChecksum
+	}
+	if data, err = removeIndexExtensions(data); err != nil {
+		return nil, err
+	}
+	idx := &index.Index{}
+	if err := index.NewDecoder(bytes.NewReader(data)).Decode(idx); err != nil {
+		return nil, err
+	}
+	return idx.Entries, nil
+}
+
+// removeIndexExtensions returns the index data without its extensions, with a new checksum.  go-git's
+// decoder stops at the first extension it does not know, and only the entries are needed.  Optional
+// extensions, whose signatures start with an upper case letter, are ones git itself may ignore.
+// Others change how the entries are to be read, like the "link" extension of a split index, and
+// cause an error.  Data that is not a version 2 to 4 index is returned as it is for the decoder to
+// reject.
+func removeIndexExtensions(data []byte) ([]byte, error) {
+	end := len(data) - sha1.Size
+	offset, err := indexEntriesEnd(data[:end])
+	if err != nil || offset == end {
+		return data, err
+	}
+	for extension := offset; extension < end; {
+		if extension+8 > end {
+			return nil, io.ErrUnexpectedEOF
+		}
+		signature := data[extension : extension+4]
+		size := binary.BigEndian.Uint32(data[extension+4 : extension+8])
+		if uint64(size) > uint64(end-extension-8) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if signature[0] < 'A' || signature[0] > 'Z' {
+			return nil, fmt.Errorf("%w %q", ErrUnsupportedGitIndex, signature)
+		}
+		extension += 8 + int(size)
+	}
+	stripped := append([]byte{}, data[:offset]...)
+	sum := sha1.Sum(stripped)
+	return append(stripped, sum[:]...), nil
+}
+
+// indexEntriesEnd returns the offset of the first extension in the index data, which does not
+// include the checksum, or len(data) if there are none.
+func indexEntriesEnd(data []byte) (int, error) {
+	const (
+		headerSize = 12
+		// The times, device, inode, mode, user, group, size, object name and flags
+		entrySize        = 62
+		extendedFlag     = 0x4000
+		extendedFlagSize = 2
+	)
+	if len(data) < headerSize || string(data[:4]) != "DIRC" {
+		return len(data), nil
+	}
+	version := binary.BigEndian.Uint32(data[4:8])
+	if version < 2 || version > 4 {
+		return len(data), nil
+	}
+	count := binary.BigEndian.Uint32(data[8:12])
+	offset := headerSize
+	for i := uint32(0); i < count; i++ {
+		start := offset
+		if offset += entrySize; offset > len(data) {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if version >= 3 && binary.BigEndian.Uint16(data[offset-2:offset])&extendedFlag != 0 {
+			offset += extendedFlagSize
+		}
+		if version == 4 {
+			// The name is the number of bytes to remove from the previous one, as a variable length
+			// integer, and the suffix to append to it, terminated by a NUL
+			for offset < len(data) && data[offset]&0x80 != 0 {
+				offset++
+			}
+			offset++
+		}
+		if offset > len(data) {
+			return 0, io.ErrUnexpectedEOF
+		}
+		nul := bytes.IndexByte(data[offset:], 0)
+		if nul < 0 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		offset += nul + 1
+		if version < 4 {
+			// Entries are padded with NULs to a multiple of eight bytes
+			offset = start + (offset-start+7)&^7
+			if offset > len(data) {
+				return 0, io.ErrUnexpectedEOF
+			}
+		}
+	}
+	return offset, nil
+}
+
+// isIndexFile returns true if mode is that of a regular file, executable or not, in the index.
+func isIndexFile(mode filemode.FileMode) bool {
+	return mode.IsRegular() || mode == filemode.Executable
+}
+
+// trackedSet holds the paths tracked by git, relative to the top of the working tree and separated by
+// "/".
+type trackedSet struct {
+	files map[string]*index.Entry
+	// dirs holds the directories containing tracked files
+	dirs map[string]bool
+	// trees holds submodules, whose contents are all tracked
+	trees map[string]bool
+	// children maps directories, including "" for the top, to the names of the tracked entries in them
+	children map[string][]string
+	// unmerged holds the files with unresolved merge conflicts, which have no staged contents
+	unmerged map[string]bool
+}
+
+// readTrackedSet returns the paths tracked in the worktree with git directory gitDir: those in the
+// commit that is checked out if head is true, and those in the index otherwise.
+func readTrackedSet(gitDir string, objects *gitObjects, head bool) (*trackedSet, error) {
+	var entries []*index.Entry
+	var err error
+	if head {
+		entries, err = objects.readHeadTree(gitDir)
+	} else {
+		entries, err = readIndex(gitDir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newTrackedSet(entries), nil
+}
+
+func newTrackedSet(entries []*index.Entry) *trackedSet {
+	s := &trackedSet{files: map[string]*index.Entry{}, dirs: map[string]bool{}, trees: map[string]bool{}, children: map[string][]string{}, unmerged: map[string]bool{}}
+	for _, entry := range entries {
+		name := entry.Name
+		// Merged entries have stage 0, despite go-git's index.Merged constant.  Unmerged paths have an
+		// entry for each side of the conflict instead.
+		if entry.Stage != 0 {
+			s.unmerged[name] = true
+		}
+		if _, seen := s.files[name]; seen {
+			continue
+		}
+		if entry.Mode == filemode.Submodule {
+			s.trees[name] = true
+		} else {
+			s.files[name] = entry
+		}
+		for child := name; ; {
+			slash := strings.LastIndex(child, "/")
+			dir := ""
+			if slash >= 0 {
+				dir = child[:slash]
+			}
+			names := s.children[dir]
+			if base := child[slash+1:]; len(names) == 0 || names[len(names)-1] != base {
+				// Entries are sorted, so a repeated name is always the last one
+				s.children[dir] = append(names, base)
+			}
+			if slash < 0 || s.dirs[dir] {
+				break
+			}
+			s.dirs[dir] = true
+			child = dir
+		}
+	}
+	return s
+}
+
+// isTracked returns true if the entry at the relative path is tracked, or is a directory that
+// contains tracked files.
+func (s *trackedSet) isTracked(relPath []string, isDir bool) bool {
+	for i := 1; i < len(relPath); i++ {
+		if s.trees[strings.Join(relPath[:i], "/")] {
+			return true
+		}
+	}
+	name := strings.Join(relPath, "/")
+	if isDir {
+		return s.dirs[name] || s.trees[name]
+	}
+	_, tracked := s.files[name]
+	return tracked
+}
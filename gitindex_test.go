@@ -0,0 +1,369 @@
+package lndir
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// git runs a git command in dir
+func git(t *testing.T, dir string, args ...string) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+	cmd.Dir = dir
+	if output, err := cmd.CombinedOutput(); !assert.NoError(t, err, string(output)) {
+		t.FailNow()
+	}
+}
+
+func TestLndirContextGitTracked(t *testing.T) {
+	source := makeTree(t, "tracked", "dir1/tracked", "dir1/untracked", "dir2/untracked", "ignored-but-tracked", "ignored", ".gitignore")
+	defer os.RemoveAll(source)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(source, ".gitignore"), []byte("ignored*\n"), 0666))
+	git(t, source, "init", "-q")
+	git(t, source, "add", "tracked", "dir1/tracked", ".gitignore")
+	git(t, source, "add", "-f", "ignored-but-tracked")
+
+	linked := func(config Config) []string {
+		target := makeTree(t)
+		defer os.RemoveAll(target)
+		config.Silent, config.Logger = true, discardLogger{}
+		result, err := LndirContext(context.Background(), source, target, config)
+		assert.NoError(t, err)
+		var names []string
+		for _, link := range result.CreatedLinks {
+			rel, _ := filepath.Rel(target, link.Path)
+			names = append(names, filepath.ToSlash(rel))
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	for _, version := range []string{"2", "4"} {
+		git(t, source, "update-index", "--index-version", version)
+		assert.Equal(t, []string{".gitignore", "dir1/tracked", "ignored-but-tracked", "tracked"}, linked(Config{GitTracked: true}))
+		assert.Equal(t, []string{".gitignore", "dir1/tracked", "dir1/untracked", "dir2/untracked", "ignored-but-tracked", "tracked"}, linked(Config{GitTracked: true, IncludeUntracked: true}))
+	}
+
+	target := makeTree(t)
+	defer os.RemoveAll(target)
+	_, err := LndirContext(context.Background(), target, source, Config{Silent: true, GitTracked: true, Logger: discardLogger{}})
+	assert.True(t, errors.Is(err, ErrNotGitWorkTree))
+	assert.True(t, IsUserError(err))
+}
+
+func TestLndirContextGitHead(t *testing.T) {
+	source := makeTree(t, "committed", "dir1/committed", "staged", "deleted")
+	defer os.RemoveAll(source)
+	git(t, source, "init", "-q")
+	git(t, source, "add", "committed", "dir1/committed", "deleted")
+	git(t, source, "commit", "-q", "-m", "initial")
+	git(t, source, "add", "staged")
+	git(t, source, "rm", "-q", "--cached", "deleted")
+
+	linked := func(source string, config Config) []string {
+		target := makeTree(t)
+		defer os.RemoveAll(target)
+		config.Silent, config.Logger = true, discardLogger{}
+		result, err := LndirContext(context.Background(), source, target, config)
+		assert.NoError(t, err)
+		var names []string
+		for _, link := range result.CreatedLinks {
+			rel, _ := filepath.Rel(target, link.Path)
+			names = append(names, filepath.ToSlash(rel))
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	assert.Equal(t, []string{"committed", "dir1/committed", "staged"}, linked(source, Config{GitTracked: true}))
+	assert.Equal(t, []string{"committed", "deleted", "dir1/committed"}, linked(source, Config{GitTracked: true, GitHead: true}))
+
+	// A linked worktree has its own HEAD
+	worktree := filepath.Join(makeTree(t), "worktree")
+	defer os.RemoveAll(filepath.Dir(worktree))
+	git(t, source, "worktree", "add", "-q", "--detach", worktree)
+	git(t, source, "commit", "-q", "-m", "second")
+	assert.Equal(t, []string{"committed", "dir1/committed", "staged"}, linked(source, Config{GitTracked: true, GitHead: true}))
+	assert.Equal(t, []string{"committed", "deleted", "dir1/committed"}, linked(worktree, Config{GitTracked: true, GitHead: true}))
+}
+
+func TestLndirContextGitIndexExtensions(t *testing.T) {
+	// Names of every length modulo eight, so that the entries need every amount of padding
+	var tracked []string
+	for i := 0; i < 8; i++ {
+		tracked = append(tracked, "tracked"+strings.Repeat("-", i))
+	}
+	source := makeTree(t, append(tracked, "intent-to-add", "untracked")...)
+	defer os.RemoveAll(source)
+	git(t, source, "init", "-q")
+	git(t, source, append([]string{"add"}, tracked...)...)
+	// Entries added with intent to add have extended flags
+	git(t, source, "add", "-N", "intent-to-add")
+	target := makeTree(t)
+	defer os.RemoveAll(target)
+
+	// Optional extensions are ignored
+	git(t, source, "-c", "core.untrackedCache=true", "update-index", "--untracked-cache")
+	for _, version := range []string{"3", "4"} {
+		git(t, source, "update-index", "--index-version", version)
+		git(t, source, "-c", "core.untrackedCache=true", "status", "-s")
+		result, err := LndirContext(context.Background(), source, target, Config{Silent: true, GitTracked: true, DryRun: true, Logger: discardLogger{}})
+		if assert.NoError(t, err, version) {
+			assert.Len(t, result.CreatedLinks, len(tracked)+1, version)
+			assert.Contains(t, result.CreatedLinks, Link{Path: filepath.Join(target, "intent-to-add"), Text: filepath.Join(source, "intent-to-add")}, version)
+		}
+	}
+
+	// Split indexes are not supported
+	git(t, source, "update-index", "--split-index")
+	_, err := LndirContext(context.Background(), source, target, Config{Silent: true, GitTracked: true, Logger: discardLogger{}})
+	assert.True(t, errors.Is(err, ErrUnsupportedGitIndex), "%v", err)
+}
+
+func TestLndirContextStaged(t *testing.T) {
+	// Large enough for the staged version, which is smaller, to be stored as a delta when packed
+	large := strings.Repeat("line of text\n", 1000)
+	source := makeTree(t, "unchanged", "changed", "executable", "deleted", "dir/deleted", "untracked")
+	defer os.RemoveAll(source)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(source, "changed"), []byte(large+"committed\n"), 0666))
+	git(t, source, "init", "-q")
+	git(t, source, "add", "unchanged", "changed", "deleted", "dir/deleted")
+	git(t, source, "commit", "-q", "-m", "initial")
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(source, "changed"), []byte(large), 0666))
+	assert.NoError(t, os.Chmod(filepath.Join(source, "executable"), 0777))
+	git(t, source, "add", "changed", "executable")
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(source, "changed"), []byte("not staged"), 0666))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(source, "executable"), []byte("not staged"), 0777))
+	assert.NoError(t, os.Remove(filepath.Join(source, "deleted")))
+	assert.NoError(t, os.RemoveAll(filepath.Join(source, "dir")))
+
+	for _, packed := range []bool{false, true} {
+		if packed {
+			git(t, source, "gc", "-q")
+		}
+		target := makeTree(t)
+		defer os.RemoveAll(target)
+		result, err := LndirContext(context.Background(), source, target, Config{Silent: true, Mode: ModeStaged, Logger: discardLogger{}})
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		assert.Empty(t, result.Errors)
+
+		link, _ := os.Readlink(filepath.Join(target, "unchanged"))
+		assert.Equal(t, filepath.Join(source, "unchanged"), link)
+		for name, contents := range map[string]string{"changed": large, "executable": "executable", "deleted": "deleted", "dir/deleted": "dir/deleted"} {
+			info, err := os.Lstat(filepath.Join(target, name))
+			if assert.NoError(t, err, name) {
+				assert.True(t, info.Mode().IsRegular(), name)
+			}
+			data, _ := ioutil.ReadFile(filepath.Join(target, name))
+			assert.Equal(t, contents, string(data), name)
+		}
+		info, _ := os.Stat(filepath.Join(target, "executable"))
+		assert.NotZero(t, info.Mode()&0100)
+		_, err = os.Lstat(filepath.Join(target, "untracked"))
+		assert.True(t, os.IsNotExist(err))
+
+		result, err = LndirContext(context.Background(), source, target, Config{Silent: true, Mode: ModeStaged, Logger: discardLogger{}})
+		assert.NoError(t, err)
+		assert.Empty(t, result.CreatedLinks)
+		assert.Empty(t, result.Conflicts)
+	}
+}
+
+func TestLndirContextStagedFollowsIndex(t *testing.T) {
+	source := makeTree(t, "added", "linked", "restaged")
+	defer os.RemoveAll(source)
+	git(t, source, "init", "-q")
+	git(t, source, "add", ".")
+	git(t, source, "commit", "-q", "-m", "initial")
+	write := func(name, contents string) {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(source, name), []byte(contents), 0666))
+	}
+	write("added", "staged")
+	write("restaged", "staged")
+	git(t, source, "add", "added", "restaged")
+	write("added", "not staged")
+	write("restaged", "not staged")
+
+	target := makeTree(t)
+	defer os.RemoveAll(target)
+	config := Config{Silent: true, Mode: ModeStaged, Logger: discardLogger{}}
+	_, err := LndirContext(context.Background(), source, target, config)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	// Each entry changes from a file to a link, from a link to a file, or to a file with other contents
+	write("linked", "staged")
+	write("restaged", "staged again")
+	git(t, source, "add", "added", "linked", "restaged")
+	write("linked", "not staged")
+	write("restaged", "not staged")
+
+	result, err := LndirContext(context.Background(), source, target, config)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Empty(t, result.Conflicts)
+	assert.Empty(t, result.Errors)
+	sort.Strings(result.Replaced)
+	assert.Equal(t, []string{filepath.Join(target, "added"), filepath.Join(target, "linked"), filepath.Join(target, "restaged")}, result.Replaced)
+
+	link, _ := os.Readlink(filepath.Join(target, "added"))
+	assert.Equal(t, filepath.Join(source, "added"), link)
+	for name, contents := range map[string]string{"linked": "staged", "restaged": "staged again"} {
+		info, err := os.Lstat(filepath.Join(target, name))
+		if assert.NoError(t, err, name) {
+			assert.True(t, info.Mode().IsRegular(), name)
+		}
+		data, _ := ioutil.ReadFile(filepath.Join(target, name))
+		assert.Equal(t, contents, string(data), name)
+	}
+	matches, _ := filepath.Glob(filepath.Join(target, "*"+tmpSuffix+"*"))
+	assert.Empty(t, matches)
+}
+
+func TestLndirContextStagedSkipsUnmergedFiles(t *testing.T) {
+	source := makeTree(t, "conflicted", "other")
+	defer os.RemoveAll(source)
+	git(t, source, "init", "-q")
+	git(t, source, "add", ".")
+	git(t, source, "commit", "-q", "-m", "initial")
+	git(t, source, "checkout", "-q", "-b", "theirs")
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(source, "conflicted"), []byte("theirs"), 0666))
+	git(t, source, "commit", "-q", "-a", "-m", "theirs")
+	git(t, source, "checkout", "-q", "-")
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(source, "conflicted"), []byte("ours"), 0666))
+	git(t, source, "commit", "-q", "-a", "-m", "ours")
+	// The merge fails because of the conflict
+	cmd := exec.Command("git", "-c", "user.name=test", "-c", "user.email=test@example.com", "merge", "-q", "theirs")
+	cmd.Dir = source
+	assert.Error(t, cmd.Run())
+
+	target := makeTree(t)
+	defer os.RemoveAll(target)
+	result, err := LndirContext(context.Background(), source, target, Config{Silent: true, Mode: ModeStaged, Logger: discardLogger{}})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Contains(t, result.Skipped, SkippedEntry{Path: filepath.Join(source, "conflicted"), Reason: SkipUnmerged})
+	_, err = os.Lstat(filepath.Join(target, "conflicted"))
+	assert.True(t, os.IsNotExist(err))
+	link, _ := os.Readlink(filepath.Join(target, "other"))
+	assert.Equal(t, filepath.Join(source, "other"), link)
+}
+
+func TestLndirContextStagedDeletedFilesAreFiltered(t *testing.T) {
+	source := makeTree(t, "deleted", "excluded.tmp", "ignored", "vetoed", "vetoed-dir/file", "dir/deleted")
+	defer os.RemoveAll(source)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(source, DefaultIgnoreFile), []byte("ignored\n"), 0666))
+	git(t, source, "init", "-q")
+	git(t, source, "add", ".")
+	git(t, source, "commit", "-q", "-m", "initial")
+	for _, name := range []string{"deleted", "excluded.tmp", "ignored", "vetoed", "vetoed-dir", "dir"} {
+		assert.NoError(t, os.RemoveAll(filepath.Join(source, name)))
+	}
+
+	target := makeTree(t)
+	defer os.RemoveAll(target)
+	var dirs, links []string
+	config := Config{
+		Silent:  true,
+		Logger:  discardLogger{},
+		Mode:    ModeStaged,
+		Exclude: []string{"*.tmp"},
+		OnDir: func(event DirEvent) bool {
+			dirs = append(dirs, filepath.Base(event.Source))
+			return filepath.Base(event.Source) != "vetoed-dir"
+		},
+		OnLink: func(event LinkEvent) bool {
+			links = append(links, filepath.Base(event.Source))
+			assert.Equal(t, ModeStaged, event.Mode)
+			return filepath.Base(event.Source) != "vetoed"
+		},
+	}
+	result, err := LndirContext(context.Background(), source, target, config)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Empty(t, result.Errors)
+
+	sort.Strings(dirs)
+	sort.Strings(links)
+	assert.Equal(t, []string{"dir", "vetoed-dir"}, dirs)
+	assert.Equal(t, []string{"deleted", "deleted", "vetoed"}, links)
+	for _, entry := range []SkippedEntry{
+		{Path: filepath.Join(source, "excluded.tmp"), Reason: SkipExcluded},
+		{Path: filepath.Join(source, "ignored"), Reason: SkipIgnoreFile},
+		{Path: filepath.Join(source, "vetoed"), Reason: SkipVetoed},
+		{Path: filepath.Join(source, "vetoed-dir"), Reason: SkipVetoed},
+	} {
+		assert.Contains(t, result.Skipped, entry)
+	}
+
+	for _, name := range []string{"deleted", "dir/deleted"} {
+		_, err := os.Lstat(filepath.Join(target, name))
+		assert.NoError(t, err, name)
+	}
+	for _, name := range []string{"excluded.tmp", "ignored", "vetoed", "vetoed-dir"} {
+		_, err := os.Lstat(filepath.Join(target, name))
+		assert.True(t, os.IsNotExist(err), name)
+	}
+}
+
+func TestLndirContextStagedKeepsFilesItDidNotWrite(t *testing.T) {
+	source := makeTree(t, "empty", "changed")
+	defer os.RemoveAll(source)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(source, "empty"), nil, 0666))
+	git(t, source, "init", "-q")
+	git(t, source, "add", ".")
+	git(t, source, "commit", "-q", "-m", "initial")
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(source, "changed"), []byte("staged"), 0666))
+	git(t, source, "add", "changed")
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(source, "changed"), []byte("not staged"), 0666))
+
+	// These have contents that git has, but were not written by ModeStaged
+	target := makeTree(t, "changed")
+	defer os.RemoveAll(target)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(target, "empty"), nil, 0666))
+
+	config := Config{Silent: true, Mode: ModeStaged, Logger: discardLogger{}}
+	result, err := LndirContext(context.Background(), source, target, config)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	sort.Slice(result.Conflicts, func(i, j int) bool { return result.Conflicts[i].Path < result.Conflicts[j].Path })
+	assert.Equal(t, []Conflict{
+		{Path: filepath.Join(target, "changed"), Reason: ConflictModifiedFile},
+		{Path: filepath.Join(target, "empty"), Reason: ConflictFileForLink},
+	}, result.Conflicts)
+	assert.Empty(t, result.Replaced)
+	data, _ := ioutil.ReadFile(filepath.Join(target, "changed"))
+	assert.Equal(t, "changed", string(data))
+
+	// Once they are out of the way, the files written are recorded, and the record is not part of
+	// the shadow tree
+	assert.NoError(t, os.Remove(filepath.Join(target, "changed")))
+	assert.NoError(t, os.Remove(filepath.Join(target, "empty")))
+	_, err = LndirContext(context.Background(), source, target, config)
+	assert.NoError(t, err)
+	data, _ = ioutil.ReadFile(filepath.Join(target, StagedRecordName))
+	assert.Equal(t, "f3a38e78de7fff937c5089326dcfcbefec204da5 changed\n", string(data))
+	config.Prune = true
+	result, err = LndirContext(context.Background(), source, target, config)
+	assert.NoError(t, err)
+	assert.Empty(t, result.Kept)
+}
@@ -0,0 +1,105 @@
+package lndir
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"gopkg.in/src-d/go-billy.v4/osfs"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/cache"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/index"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+	"gopkg.in/src-d/go-git.v4/storage/filesystem"
+)
+
+// gitObjects reads from the object database of a repository, which is shared by all its worktrees.
+// go-git's storage must not be used by several goroutines at once, so access is serialized.
+type gitObjects struct {
+	mu      sync.Mutex
+	storage *filesystem.Storage
+}
+
+func openGitObjects(gitDir string) *gitObjects {
+	return &gitObjects{storage: filesystem.NewStorage(osfs.New(commonGitDir(gitDir)), cache.NewObjectLRUDefault())}
+}
+
+// readBlob returns the contents of the blob with the given name.
+func (o *gitObjects) readBlob(hash plumbing.Hash) ([]byte, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	blob, err := object.GetBlob(o.storage, hash)
+	if err != nil {
+		return nil, err
+	}
+	r, err := blob.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// readHeadTree returns the files, links and submodules in the tree of the commit checked out in
+// the worktree with git directory gitDir, as index entries without any file information.
+func (o *gitObjects) readHeadTree(gitDir string) ([]*index.Entry, error) {
+	// HEAD belongs to the worktree, while the branches it may refer to are shared
+	data, err := ioutil.ReadFile(filepath.Join(gitDir, "HEAD"))
+	if err != nil {
+		return nil, err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	head := plumbing.NewReferenceFromStrings(string(plumbing.HEAD), strings.TrimSpace(string(data)))
+	if head.Type() == plumbing.SymbolicReference {
+		if head, err = storer.ResolveReference(o.storage, head.Target()); err != nil {
+			return nil, err
+		}
+	}
+	commit, err := object.GetCommit(o.storage, head.Hash())
+	if err != nil {
+		return nil, err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*index.Entry
+	walker := object.NewTreeWalker(tree, true, nil)
+	defer walker.Close()
+	for {
+		name, entry, err := walker.Next()
+		if err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if entry.Mode != filemode.Dir {
+			entries = append(entries, &index.Entry{Name: name, Mode: entry.Mode, Hash: entry.Hash})
+		}
+	}
+}
+
+// fileBlobHash returns the name git would give to the contents of the file name.
+func fileBlobHash(name string) (plumbing.Hash, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	hasher := plumbing.NewHasher(plumbing.BlobObject, info.Size())
+	if _, err := io.Copy(hasher, f); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return hasher.Sum(), nil
+}
@@ -0,0 +1,90 @@
+package lndir
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"gopkg.in/src-d/go-git.v4/plumbing/format/gitignore"
+)
+
+// DefaultIgnoreFile is the name of the files that list source entries that should not be linked
+const DefaultIgnoreFile = ".lndirignore"
+
+// ignoreFiles implements Config.IgnoreFile and reads .gitignore files.  The ignore file in each
+// source directory is read the first time an entry in that directory is checked, and its patterns
+// apply to the directory and everything below it, overriding those of the directories above, which
+// override the base patterns.  Since skipped directories are never checked, ignore files in them are
+// never read.
+type ignoreFiles struct {
+	root string
+	// name is the name of the ignore files, or "" if only the base patterns apply
+	name string
+	base []gitignore.Pattern
+	// reason is given for entries matched by the patterns
+	reason SkipReason
+	// linkSelf is false if the ignore files themselves should be skipped
+	linkSelf bool
+
+	mu sync.Mutex
+	// patterns holds the patterns that apply in each directory visited so far, keyed by its path
+	// relative to root
+	patterns map[string][]gitignore.Pattern
+}
+
+func newIgnoreFiles(root, name string, base []gitignore.Pattern, reason SkipReason, linkSelf bool) *ignoreFiles {
+	return &ignoreFiles{root: root, name: name, base: base, reason: reason, linkSelf: linkSelf, patterns: map[string][]gitignore.Pattern{}}
+}
+
+// load returns the patterns that apply to the entries of the directory dir, which is relative to the
+// root.  An ignore file that cannot be read is treated as empty, and the error is only returned the
+// first time.
+func (f *ignoreFiles) load(dir []string) ([]gitignore.Pattern, error) {
+	key := strings.Join(dir, "/")
+	f.mu.Lock()
+	patterns, ok := f.patterns[key]
+	f.mu.Unlock()
+	if ok {
+		return patterns, nil
+	}
+
+	if len(dir) > 0 {
+		// Errors from the directories above were reported when they were loaded
+		patterns, _ = f.load(dir[:len(dir)-1])
+	} else {
+		patterns = f.base
+	}
+	var err error
+	if f.name != "" {
+		var own []gitignore.Pattern
+		own, err = readPatternFile(filepath.Join(f.root, filepath.Join(dir...), f.name), dir)
+		patterns = append(patterns[:len(patterns):len(patterns)], own...)
+	}
+
+	f.mu.Lock()
+	f.patterns[key] = patterns
+	f.mu.Unlock()
+	return patterns, err
+}
+
+func (f *ignoreFiles) Skip(relPath []string, info os.FileInfo) (bool, SkipReason) {
+	name := relPath[len(relPath)-1]
+	if name == f.name && !f.linkSelf && !isDir(info) {
+		return true, f.reason
+	}
+	patterns, _ := f.load(relPath[:len(relPath)-1])
+	for i := len(patterns) - 1; i >= 0; i-- {
+		if match := patterns[i].Match(relPath, isDir(info)); match > gitignore.NoMatch {
+			return match == gitignore.Exclude, f.reason
+		}
+	}
+	return false, ""
+}
+
+func ignoreFileName(config Config) string {
+	if config.IgnoreFile == "" {
+		return DefaultIgnoreFile
+	}
+	return config.IgnoreFile
+}
@@ -0,0 +1,28 @@
+package lndir
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIgnoreFilesDoNotOverwriteThePath(t *testing.T) {
+	source := makeTree(t, "dir/a.txt", "dir/b.go")
+	defer os.RemoveAll(source)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(source, DefaultIgnoreFile), []byte("*.txt\n"), 0666))
+	info, err := os.Lstat(filepath.Join(source, "dir", "a.txt"))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	// Give the path spare capacity, as the paths built while walking a tree usually have, so that
+	// appending to the parent directory's path would overwrite the entry's name
+	relPath := append(make([]string, 0, 4), "dir", "a.txt")
+	skip, reason := newIgnoreFiles(source, DefaultIgnoreFile, nil, SkipIgnoreFile, false).Skip(relPath, info)
+	assert.True(t, skip)
+	assert.Equal(t, SkipIgnoreFile, reason)
+	assert.Equal(t, []string{"dir", "a.txt"}, relPath)
+}
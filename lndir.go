@@ -29,7 +29,10 @@ in this Software without prior written authorization from The Open Group.
 */
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"math"
 	"os"
@@ -37,16 +40,88 @@ import (
 	"runtime"
 	"strings"
 	"syscall"
-
-	"gopkg.in/src-d/go-billy.v3/osfs"
-	"gopkg.in/src-d/go-git.v4/plumbing/format/gitignore"
 )
 
 var isOSX = runtime.GOOS == "darwin"
 
 type Config struct {
 	Silent, IgnoreLinks, WithRevInfo, UseGitignore bool
-	Logger                                         Logger
+	// RevInfoNames lists the revision control directories that are skipped unless WithRevInfo is set,
+	// JunkNames the backup and editor files that are always skipped, and OSJunkNames the files left by
+	// file managers that are skipped according to OSJunk.  Names may contain filepath.Match wildcards.
+	// A nil list means DefaultRevInfoNames, DefaultJunkNames or DefaultOSJunkNames, and an empty one
+	// skips nothing.  These are ignored if Filter is set.
+	RevInfoNames, JunkNames, OSJunkNames []string
+	OSJunk                               OSJunkPolicy
+	// UseGitInfoExclude excludes files listed in .git/info/exclude, and UseGlobalGitignore those listed
+	// in the file named by git's core.excludesFile setting, which defaults to
+	// $XDG_CONFIG_HOME/git/ignore.  As with git, patterns in .gitignore files take precedence over
+	// .git/info/exclude, which takes precedence over the global file.  The source directory is
+	// assumed to be the top of its git working tree.
+	UseGitInfoExclude, UseGlobalGitignore bool
+	// GitTracked links only the files in the git index of the source directory, which must be the top of
+	// its working tree.  With IncludeUntracked, files that are not tracked are also linked unless git
+	// would ignore them, according to the .gitignore files, .git/info/exclude and the global excludes
+	// file.  Patterns from the ignore files never exclude tracked files.  With GitHead, the files in
+	// the commit that is checked out are used instead of those in the index, except by ModeStaged.
+	GitTracked, IncludeUntracked, GitHead bool
+	// Filter decides which source entries are linked, in addition to the gitignore options.  If it is
+	// nil, DefaultFilter(config) is used.  Use Filters to combine the default with other filters.
+	Filter Filter
+	// Exclude lists gitignore-style patterns, relative to the source directory, for entries that should
+	// not be linked.  Include lists patterns for entries that should be linked even though they match
+	// Exclude; they are applied after Exclude, and a pattern in Exclude that starts with "!" has the
+	// same effect.  Later patterns override earlier ones.  Neither affects what the gitignore options
+	// skip.
+	Exclude, Include []string
+	// IgnoreFile is the name of the files, DefaultIgnoreFile if it is empty, that list gitignore-style
+	// patterns for entries that should not be linked.  Each source directory may have one, whose
+	// patterns apply to the entries below it.  It is read whether or not UseGitignore is set, unless
+	// NoIgnoreFile is true.  The ignore files themselves are not linked unless LinkIgnoreFiles is true.
+	IgnoreFile                    string
+	NoIgnoreFile, LinkIgnoreFiles bool
+	// Mode determines whether files are symlinked, hard linked, copied or cloned.  Links in the source
+	// tree are reproduced as links in every mode unless IgnoreLinks is set.  Nothing records which files
+	// were hard linked, copied or cloned, so Prune leaves them in place when their source is deleted
+	// and Verify reports them as extra files.
+	Mode Mode
+	// Fold links source subdirectories as a whole, instead of recreating them, when the target
+	// directory does not exist yet and nothing below the source directory would be skipped.  Folded
+	// directories are unfolded into real directories when that is no longer the case.  Only
+	// applies to ModeSymlink, and not when OnDir or OnLink is set.
+	Fold bool
+	// DryRun walks the source tree and reports what would be done in the Result without changing the target
+	DryRun bool
+	// Prune removes links in the target that point into the source tree but are dangling or now excluded,
+	// along with any directories left empty by their removal and empty directories whose source
+	// directory was deleted.  Only symbolic links are removed, whatever the Mode.
+	Prune bool
+	// OnConflict determines what happens to existing entries that are in the way of links and directories
+	OnConflict ConflictPolicy
+	// BackupSuffix is appended to the names of entries moved aside by ConflictPolicyBackup
+	BackupSuffix string
+	// Concurrency is the maximum number of directories to process at once.  Values below 2 process
+	// the tree sequentially.  Output and results are reported in the same order either way.
+	Concurrency int
+	// FailFast stops at the first error for an individual entry and returns it.  Otherwise, such errors
+	// are logged and the walk continues.
+	FailFast bool
+	// CollectErrors returns an EntryErrors listing every error for an individual entry, if there were any
+	CollectErrors bool
+	Logger        Logger
+	// OnDir, if not nil, is called before each source subdirectory is entered, and OnLink before each
+	// source file is linked, whether or not the target already has the link.  If they return false, the
+	// directory or file is left alone and reported as skipped with SkipVetoed.  OnSkip is called for
+	// each source entry that is skipped, OnError for each error recorded in Result.Errors, and OnEvent
+	// for everything else recorded in the Result, as it happens.  They are also called in a dry run.
+	// OnDir and OnLink may be called concurrently if Concurrency is above 1, while the others are then
+	// called one at a time, in the same order as in a sequential walk, once the directories involved
+	// have been processed.
+	OnDir   func(DirEvent) bool
+	OnLink  func(LinkEvent) bool
+	OnSkip  func(SkippedEntry)
+	OnError func(error)
+	OnEvent func(Event)
 }
 
 type Logger interface {
@@ -56,70 +131,283 @@ type Logger interface {
 
 type directoryLinker struct {
 	silent, ignoreLinks, withRevInfo, useGitignore bool
-	gitignoreMatcher                               gitignore.Matcher
-	currentPath                                    path
-	logger                                         Logger
-}
-
-type userError struct {
-	error
+	useGitInfoExclude, useGlobalGitignore          bool
+	gitObjects                                     *gitObjects
+	stagedRecord                                   *stagedRecord
+	dryRun, prune, fold, shallow, unlinking        bool
+	mode                                           Mode
+	sourceRoot                                     string
+	onConflict                                     ConflictPolicy
+	backupSuffix                                   string
+	filter                                         Filter
+	gitFilter                                      *gitFilter
+	ignoreFiles                                    *ignoreFiles
+	// lstatAll is set if the filter needs information about every entry
+	lstatAll    bool
+	workers     chan struct{}
+	failure     *failure
+	abort       *failure
+	overlay     *overlay
+	layer       int
+	currentPath path
+	unfolding   string
+	foldCache   *foldCache
+	logger      Logger
+	onDir       func(DirEvent) bool
+	onLink      func(LinkEvent) bool
+	onSkip      func(SkippedEntry)
+	onError     func(error)
+	onEvent     func(Event)
+	stdout      io.Writer
+	result      *Result
+	segments    []*segment
 }
 
-func newUserError(format string, v ...interface{}) userError {
-	return userError{fmt.Errorf(format, v...)}
+func Lndir(fromPath, toPath string, config Config) error {
+	_, err := LndirContext(context.Background(), fromPath, toPath, config)
+	return err
 }
 
-func IsUserError(err error) bool {
-	_, isUserError := err.(userError)
-	return isUserError
+// LndirContext is like Lndir but stops walking the source tree as soon as ctx is done, in which case
+// the returned error wraps ctx.Err() and names the source path at which processing stopped.  The
+// returned Result is never nil and describes the work done up to the point of any error.
+func LndirContext(ctx context.Context, fromPath, toPath string, config Config) (*Result, error) {
+	result := &Result{}
+	err := lndir(ctx, fromPath, toPath, config, result, nil, 0)
+	if err == nil && config.CollectErrors && len(result.Errors) > 0 {
+		err = EntryErrors(result.Errors)
+	}
+	return result, err
 }
 
-func Lndir(fromPath, toPath string, config Config) error {
+func newDirectoryLinker(config Config, result *Result) *directoryLinker {
 	logger := config.Logger
 
 	if logger == nil {
 		logger = log.New(os.Stderr, "", log.LstdFlags)
 	}
 
-	linker := directoryLinker{
-		silent:      config.Silent,
-		ignoreLinks: config.IgnoreLinks,
-		withRevInfo: config.WithRevInfo,
-		logger:      logger,
+	backupSuffix := config.BackupSuffix
+	if backupSuffix == "" {
+		backupSuffix = DefaultBackupSuffix
+	}
+
+	mode := config.Mode
+	if mode == "" {
+		mode = ModeSymlink
+	}
+
+	var workers chan struct{}
+	if config.Concurrency > 1 {
+		// The calling goroutine is also a worker
+		workers = make(chan struct{}, config.Concurrency-1)
+	}
+
+	filter := config.Filter
+	if filter == nil {
+		filter = DefaultFilter(config)
+	}
+	if len(config.Exclude) > 0 || len(config.Include) > 0 {
+		patterns := append([]string{}, config.Exclude...)
+		for _, pattern := range config.Include {
+			patterns = append(patterns, "!"+pattern)
+		}
+		filter = Filters{filter, NewPatternFilter(patterns...)}
+	}
+
+	return &directoryLinker{
+		filter:             filter,
+		lstatAll:           config.Filter != nil,
+		silent:             config.Silent,
+		ignoreLinks:        config.IgnoreLinks,
+		withRevInfo:        config.WithRevInfo,
+		useGitignore:       config.UseGitignore,
+		useGitInfoExclude:  config.UseGitInfoExclude,
+		useGlobalGitignore: config.UseGlobalGitignore,
+		dryRun:             config.DryRun,
+		prune:              config.Prune,
+		mode:               mode,
+		fold:               config.Fold,
+		onConflict:         config.OnConflict,
+		backupSuffix:       backupSuffix,
+		workers:            workers,
+		logger:             logger,
+		onDir:              config.OnDir,
+		onLink:             config.OnLink,
+		onSkip:             config.OnSkip,
+		onError:            config.OnError,
+		onEvent:            config.OnEvent,
+		stdout:             os.Stdout,
+		result:             result,
+	}
+}
+
+func lndir(ctx context.Context, fromPath, toPath string, config Config, result *Result, o *overlay, layer int) error {
+	linker := newDirectoryLinker(config, result)
+	linker.overlay = o
+	linker.layer = layer
+
+	if config.FailFast {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		linker.failure = &failure{cancel: cancel}
+	}
+
+	root, err := linker.openTree(ctx, fromPath, toPath, config)
+	if err == nil {
+		err = linker.walk(ctx, root)
+	}
+
+	// The walk was canceled because of this
+	if failed := linker.failure.get(); failed != nil {
+		return failed
 	}
+	return err
+}
+
+// tree is a source directory and the target directory it is linked into.
+type tree struct {
+	// sourcePath is the source directory as it appears in links
+	sourcePath path
+	sourceName string
+	sourceDir  os.FileInfo
+	targetPath string
+	targetDir  os.FileInfo
+	// depth is the number of elements of sourcePath above the directory the gitignore patterns apply to
+	depth int
+}
 
+// openTree checks the source and target directories and prepares the linker for walking them.
+func (l *directoryLinker) openTree(ctx context.Context, fromPath, toPath string, config Config) (*tree, error) {
 	sourcePath, sourceErr := newPath(fromPath)
 	if sourceErr != nil {
-		return sourceErr
+		return nil, sourceErr
 	}
 
-	if config.UseGitignore {
-		absPath, _ := filepath.Abs(sourcePath.String())
-		fs := osfs.New(absPath)
-		if patterns, err := gitignore.ReadPatterns(fs, []string{}); err != nil {
-			return fmt.Errorf("%s: Cannot read gitignore patterns: %s", absPath, err)
-		} else {
-			linker.gitignoreMatcher = gitignore.NewMatcher(patterns)
+	if config.GitTracked || l.mode == ModeStaged {
+		// Relative source paths are relative to the target directory
+		absPath, _ := filepath.Abs(resolve(toPath, sourcePath))
+		gitDir := findGitDir(absPath)
+		if gitDir == "" {
+			return nil, userError{&PathError{Op: "git index", Source: absPath, Err: ErrNotGitWorkTree}}
+		}
+		l.gitObjects = openGitObjects(gitDir)
+		head := config.GitHead && l.mode != ModeStaged
+		tracked, err := readTrackedSet(gitDir, l.gitObjects, head)
+		if err != nil {
+			op := "git index"
+			if head {
+				op = "git HEAD"
+			}
+			return nil, &PathError{Op: op, Source: absPath, Err: err}
+		}
+		l.gitFilter = &gitFilter{tracked: tracked, includeUntracked: config.IncludeUntracked, skipUnmerged: l.mode == ModeStaged}
+		if config.IncludeUntracked {
+			l.useGitignore, l.useGitInfoExclude, l.useGlobalGitignore = true, true, true
+		}
+	}
+
+	if l.useGitignore || l.useGitInfoExclude || l.useGlobalGitignore {
+		// Relative source paths are relative to the target directory
+		absPath, _ := filepath.Abs(resolve(toPath, sourcePath))
+		patterns, err := readExcludePatterns(absPath, l.useGitInfoExclude, l.useGlobalGitignore)
+		if err != nil {
+			return nil, &PathError{Op: "gitignore", Source: absPath, Err: err}
+		}
+		// The .gitignore files are read as the walk reaches their directories
+		name := ""
+		if l.useGitignore {
+			name = ".gitignore"
 		}
+		if l.gitFilter == nil {
+			l.gitFilter = &gitFilter{}
+		}
+		l.gitFilter.ignored = newIgnoreFiles(absPath, name, patterns, SkipGitignore, true)
 	}
 
 	var fromDir, toDir os.FileInfo
 	var err error
 	if toDir, err = os.Stat(toPath); err != nil {
-		return err
+		return nil, newPathError("", toPath, err)
 	} else if !toDir.IsDir() {
-		return newUserError("%s: Not a directory", toPath)
+		return nil, userError{&PathError{Target: toPath, Err: ErrNotDirectory}}
 	}
-	if err := os.Chdir(toPath); err != nil {
-		return err
-	}
-	if fromDir, err = os.Stat(fromPath); err != nil {
-		return err
+	sourceName := resolve(toPath, sourcePath)
+	if fromDir, err = os.Stat(sourceName); err != nil {
+		return nil, newPathError(fromPath, "", err)
 	} else if !fromDir.IsDir() {
-		return newUserError("%s: Not a directory", fromPath)
+		return nil, userError{&PathError{Source: fromPath, Err: ErrNotDirectory}}
+	}
+	if l.sourceRoot, err = filepath.Abs(sourceName); err != nil {
+		return nil, err
+	}
+	if l.mode == ModeStaged {
+		if l.stagedRecord, err = readStagedRecord(toPath); err != nil {
+			return nil, newPathError("", join(toPath, StagedRecordName), err)
+		}
+	}
+	if !config.NoIgnoreFile {
+		l.ignoreFiles = newIgnoreFiles(sourceName, ignoreFileName(config), nil, SkipIgnoreFile, config.LinkIgnoreFiles)
+	}
+
+	return &tree{
+		sourcePath: sourcePath,
+		sourceName: sourceName,
+		sourceDir:  fromDir,
+		targetPath: toPath,
+		targetDir:  toDir,
+		depth:      len(sourcePath.List()),
+	}, nil
+}
+
+// walk links the contents of the tree.
+func (l *directoryLinker) walk(ctx context.Context, t *tree) error {
+	err := l.walkTree(ctx, t)
+	if !l.dryRun {
+		if saveErr := l.stagedRecord.save(); saveErr != nil {
+			l.logError("", newPathError("", l.stagedRecord.name, saveErr))
+		}
+	}
+	return err
+}
+
+func (l *directoryLinker) walkTree(ctx context.Context, t *tree) error {
+	// The source may have changed since the last walk
+	l.foldCache = newFoldCache()
+	if l.workers == nil {
+		return l.processDirectory(ctx, t.sourcePath, t.sourceName, t.sourceDir, t.targetPath, t.targetDir, t.depth)
 	}
+	logger, stdout, result := l.logger, l.stdout, l.result
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	l.abort = &failure{cancel: cancel}
+	l.startSegment()
+	err := l.processDirectory(ctx, t.sourcePath, t.sourceName, t.sourceDir, t.targetPath, t.targetDir, t.depth)
+	l.replay(result, logger, stdout)
+	// Other directories may have been canceled because of this
+	if aborted := l.abort.get(); aborted != nil {
+		err = aborted
+	}
+	l.logger, l.stdout, l.result, l.segments, l.abort = logger, stdout, result, nil, nil
+	return err
+}
 
-	return linker.processDirectory(sourcePath, fromDir, toDir, len(sourcePath.List()))
+// child returns the tree for the subdirectory name, without checking the directories.
+func (t *tree) child(name string) *tree {
+	// Limit the capacity so that appending always copies
+	child := &tree{
+		sourcePath: append(t.sourcePath[:len(t.sourcePath):len(t.sourcePath)], name),
+		sourceName: join(t.sourceName, name),
+		targetPath: join(t.targetPath, name),
+		depth:      t.depth,
+	}
+	// Relative source paths are relative to the target directory, which is now one level down
+	if !child.sourcePath.isAbs() {
+		child.sourcePath = append(path{".."}, child.sourcePath...)
+		child.depth++
+	}
+	return child
 }
 
 func newPath(pathStr string) (path, error) {
@@ -139,7 +427,21 @@ func (l *directoryLinker) logPrintf(format string, v ...interface{}) {
 	l.logger.Printf(format, v...)
 }
 
+// logError logs err and records it in the result.  err is expected to be a *PathError; other errors
+// are wrapped in one for the directory being processed.
 func (l *directoryLinker) logError(msg string, err error) {
+	var pathErr *PathError
+	if !errors.As(err, &pathErr) {
+		err = newPathError(l.currentPath.String(), "", err)
+	}
+	l.result.Errors = append(l.result.Errors, err)
+	if l.onError != nil {
+		onError := l.onError
+		l.notify(func() { onError(err) })
+	}
+	if l.failure != nil {
+		l.failure.set(err)
+	}
 	l.logFileName()
 	if msg != "" {
 		l.logger.Printf("%s", msg+":")
@@ -147,6 +449,10 @@ func (l *directoryLinker) logError(msg string, err error) {
 	l.logger.Println(err)
 }
 
+func (l *directoryLinker) printf(format string, v ...interface{}) {
+	fmt.Fprintf(l.stdout, format, v...)
+}
+
 func (l *directoryLinker) logFileName() {
 	l.logger.Printf("%s:\n", l.currentPath)
 }
@@ -155,55 +461,77 @@ func equivalent(lname path, rname path) bool {
 	return filepath.Clean(lname.String()) == filepath.Clean(rname.String())
 }
 
-func (l *directoryLinker) processSubdir(subdirName string, parentPath path, subdirInfo os.FileInfo, relativeDepth int) (err error) {
+func (l *directoryLinker) processSubdir(ctx context.Context, subdirName string, parentPath path, sourceName string, subdirInfo os.FileInfo, targetDirPath string, relativeDepth int) (err error) {
 	if subdirName == "." || subdirName == ".." {
 		return
 	}
 
-	if !l.withRevInfo && isRevInfo(subdirName) {
-		return
-	}
-
 	// These are maintained for printing the path before an error
 	originalPath := l.currentPath
 	l.currentPath = parentPath
 	if !l.silent {
-		fmt.Printf("%s:\n", parentPath)
+		l.printf("%s:\n", parentPath)
 	}
 
 	// Restore these when the method is done
+	originalUnfolding := l.unfolding
 	defer func() {
 		l.currentPath = originalPath
+		l.unfolding = originalUnfolding
 	}()
 
+	targetPath := join(targetDirPath, subdirName)
+
 	var targetInfo os.FileInfo
-	if targetInfo, err = os.Stat(subdirName); err != nil {
-		if os.IsNotExist(err) {
-			if err = os.Mkdir(subdirName, os.FileMode(0777)); err == nil {
-				if targetInfo, err = os.Stat(subdirName); err != nil {
-					l.logError(subdirName, err)
-					return
-				}
-			}
-		} else {
-			l.logError(subdirName, err)
+	create := false
+	if targetInfo, err = l.lstatTarget(targetPath); err != nil {
+		if !os.IsNotExist(err) {
+			l.logError(subdirName, newPathError(parentPath.String(), targetPath, err))
+			return
+		}
+		if l.shouldFold(parentPath, sourceName, targetPath, relativeDepth) {
+			// foldDirectory reports its own errors
+			l.foldDirectory(subdirName, parentPath, targetPath)
+			return nil
+		}
+		create = true
+	} else if l.isFolded(targetPath, targetInfo, parentPath) {
+		if l.shouldFold(parentPath, sourceName, targetPath, relativeDepth) {
+			l.record(Event{Kind: EventLinkExists, Source: parentPath.String(), Link: Link{Path: targetPath, Text: parentPath.String(), Layer: l.layer}})
+			return
+		}
+		if create = l.unfold(subdirName, parentPath, targetPath); !create {
+			return
+		}
+	} else if !targetInfo.IsDir() {
+		reason := ConflictFileForDirectory
+		if targetInfo.Mode()&os.ModeSymlink != 0 {
+			reason = ConflictLinkForDirectory
+		}
+		l.addConflict(subdirName, targetPath, reason)
+		if create, err = l.makeRoom(targetPath, reason); !create {
 			return
 		}
 	}
 
-	_, err = os.Readlink(subdirName)
-	if err == nil {
-		l.logPrintf("%s: is a link instead of a directory", subdirName)
-		return
-	}
-
-	if err = os.Chdir(subdirName); err != nil {
-		l.logError(subdirName, err)
-		return
+	if create {
+		// In a dry run, the directory is only reported and its contents are compared against nothing
+		targetInfo = nil
+		if !l.dryRun {
+			if err = os.Mkdir(targetPath, os.FileMode(0777)); err != nil {
+				l.logError(subdirName, newPathError(parentPath.String(), targetPath, err))
+				return
+			}
+			if targetInfo, err = os.Stat(targetPath); err != nil {
+				l.logError(subdirName, newPathError(parentPath.String(), targetPath, err))
+				return
+			}
+		}
+		// Another source of an overlay may already have reported the directory in a dry run
+		if !l.dryRun || l.overlay.create(targetPath) {
+			l.record(Event{Kind: EventDirCreated, Source: parentPath.String(), Target: targetPath})
+		}
 	}
-	defer func() {
-		err = os.Chdir("..")
-	}()
 
 	srcPath := parentPath
 	if !srcPath.isAbs() {
@@ -212,25 +540,29 @@ func (l *directoryLinker) processSubdir(subdirName string, parentPath path, subd
 		srcPath = append(parentRoot, parentPath...)
 	}
 
-	err = l.processDirectory(srcPath, subdirInfo, targetInfo, relativeDepth)
+	err = l.processDirectory(ctx, srcPath, sourceName, subdirInfo, targetPath, targetInfo, relativeDepth)
 	return
 }
 
-func (l *directoryLinker) processDirectory(sourceDirPath path, sourceDir os.FileInfo, targetDir os.FileInfo, baseDepth int) error {
-	if os.SameFile(sourceDir, targetDir) {
-		return newUserError("%s: From and to directories are identical!", sourceDirPath)
+// processDirectory links the contents of the source directory sourceDirName into targetDirPath.
+// sourceDirPath is the same directory as it should appear in links, so relative source paths are
+// relative to targetDirPath.  targetDir is nil if the target directory does not exist in a dry run.
+func (l *directoryLinker) processDirectory(ctx context.Context, sourceDirPath path, sourceDirName string, sourceDir os.FileInfo, targetDirPath string, targetDir os.FileInfo, baseDepth int) error {
+	if targetDir != nil && os.SameFile(sourceDir, targetDir) {
+		return userError{&PathError{Source: sourceDirPath.String(), Target: targetDirPath, Err: ErrSameDirectory}}
 	}
 
 	var err error
 	var f *os.File
-	if f, err = os.Open(sourceDirPath.String()); err != nil {
-		return fmt.Errorf("%s: Cannot open directory: %s", sourceDirPath, err)
+	if f, err = os.Open(sourceDirName); err != nil {
+		return newPathError(sourceDirPath.String(), "", err)
 	}
 
 	// Determine the maximum number of directories we might see
 	dirsLeft := math.MaxInt32
 	if s, err := f.Stat(); err != nil {
-		return fmt.Errorf("%s: Cannot stat: %s", f.Name(), err)
+		f.Close()
+		return newPathError(sourceDirPath.String(), "", err)
 	} else if stat, ok := s.Sys().(*syscall.Stat_t); ok && stat != nil {
 		// Apparently, if this is 1, we have no clue about how many subdirectories there are in this directory
 		if stat.Nlink != 1 {
@@ -239,29 +571,45 @@ func (l *directoryLinker) processDirectory(sourceDirPath path, sourceDir os.File
 	}
 
 	var children []string
-	if children, err = f.Readdirnames(0); err != nil {
-		return fmt.Errorf("%s: Cannot readdir: %s", f.Name(), err)
-	}
+	children, err = f.Readdirnames(0)
 	f.Close()
+	if err != nil {
+		return newPathError(sourceDirPath.String(), "", err)
+	}
 
-	for _, name := range children {
-		if strings.HasSuffix(name, "~") {
+	// Read the ignore files here so that errors are reported
+	for _, files := range []*ignoreFiles{l.gitFilter.ignoredFiles(), l.ignoreFiles} {
+		if files == nil {
 			continue
 		}
-
-		if isOSX && (name == ".DS_Store" || name == "._.DS_Store") {
-			continue
+		if _, err := files.load(sourceDirPath.List()[baseDepth:]); err != nil {
+			ignoreFilePath := append(sourceDirPath[:len(sourceDirPath):len(sourceDirPath)], files.name)
+			l.logError("", newPathError(ignoreFilePath.String(), "", err))
 		}
+	}
+
+	// Names of source entries that were deliberately not linked, used when pruning
+	skipped := map[string]bool{}
+	// Subdirectories being processed by other goroutines
+	var tasks []*subdirTask
 
-		sourcePath := append(sourceDirPath, name)
+	for _, name := range children {
+		// Limit the capacity so that appending always copies, since subdirectories may still be using
+		// the path after this iteration
+		sourcePath := append(sourceDirPath[:len(sourceDirPath):len(sourceDirPath)], name)
+		sourceName := join(sourceDirName, name)
+
+		if err := ctx.Err(); err != nil {
+			return &PathError{Source: sourcePath.String(), Err: err}
+		}
 
 		isDir := false
 
 		// Optimization to skip these checks once all directory entries have been processed
 		var childInfo os.FileInfo
-		if dirsLeft > 0 {
-			if childInfo, err = os.Lstat(sourcePath.String()); err != nil {
-				l.logError(sourcePath.String(), err)
+		if dirsLeft > 0 || l.lstatAll {
+			if childInfo, err = os.Lstat(sourceName); err != nil {
+				l.logError(sourcePath.String(), newPathError(sourcePath.String(), "", err))
 				continue
 			}
 
@@ -271,12 +619,35 @@ func (l *directoryLinker) processDirectory(sourceDirPath path, sourceDir os.File
 			}
 		}
 
-		if l.gitignoreMatcher != nil && l.gitignoreMatcher.Match(sourcePath.List()[baseDepth:], isDir) {
+		if reason := l.skipReason(sourcePath, childInfo, baseDepth); reason != "" {
+			l.skip(sourcePath, reason)
+			skipped[name] = true
+			continue
+		}
+
+		if !l.overlay.claim(join(targetDirPath, name), isDir) {
+			l.skip(sourcePath, SkipOverridden)
+			skipped[name] = true
 			continue
 		}
 
 		if isDir {
-			l.processSubdir(name, sourcePath, childInfo, baseDepth)
+			if l.shallow {
+				if info, err := l.lstatTarget(join(targetDirPath, name)); err == nil && info.IsDir() {
+					continue
+				}
+			}
+			if !l.allowDir(sourcePath, join(targetDirPath, name)) {
+				skipped[name] = true
+				continue
+			}
+			subdirName := name
+			err := l.walkSubdir(ctx, &tasks, func(l *directoryLinker) error {
+				return l.processSubdir(ctx, subdirName, sourcePath, sourceName, childInfo, targetDirPath, baseDepth)
+			})
+			if err != nil {
+				return err
+			}
 			continue
 		}
 
@@ -286,69 +657,183 @@ func (l *directoryLinker) processDirectory(sourceDirPath path, sourceDir os.File
 		var sourceSymlinkPath path
 		if !l.ignoreLinks {
 			// see if the file in the base tree was a symlink
-			sourceSymlinkPath = readlink(sourcePath)
+			sourceSymlinkPath = readlink(sourceName)
 		}
 
-		namePath, err := newPath(name)
-		if err != nil {
-			l.logPrintf("error processing %s: %s", name, err)
+		targetPath := join(targetDirPath, name)
+		if !l.allowLink(sourcePath, sourceSymlinkPath, targetPath) {
+			skipped[name] = true
+			continue
+		}
+		if l.mode == ModeStaged && sourceSymlinkPath == nil {
+			if entry, changed := l.stagedChange(sourcePath.List()[baseDepth:], sourceName); changed {
+				if err := l.writeStaged(name, sourcePath, entry, targetPath); err != nil {
+					return err
+				}
+				continue
+			}
+		} else if l.mode != ModeSymlink && sourceSymlinkPath == nil {
+			if err := l.materialize(name, sourcePath, sourceName, targetPath); err != nil {
+				return err
+			}
 			continue
 		}
-		existingSymlinkPath := readlink(namePath)
+
+		expectedSymlinkPath := linkText(sourcePath, sourceSymlinkPath)
+		existingSymlinkPath := l.readlinkTarget(targetPath)
 		if existingSymlinkPath != nil {
 			// Link exists in new tree.  Print message if it doesn't match.
-			expectedSymlinkPath := sourcePath
-			if sourceSymlinkPath != nil {
-				expectedSymlinkPath = sourceSymlinkPath
+			existingLink := Link{Path: targetPath, Text: existingSymlinkPath.String()}
+			if equivalent(existingSymlinkPath, expectedSymlinkPath) {
+				existingLink.Layer = l.layer
+				l.record(Event{Kind: EventLinkExists, Source: sourcePath.String(), Link: existingLink})
+				continue
 			}
-			if !equivalent(existingSymlinkPath, expectedSymlinkPath) {
-				l.logPrintf("%s: %s", name, existingSymlinkPath)
+			if l.overlay.linksToOtherSource(l.layer, targetPath) {
+				// The other source no longer has this entry, or this one now takes precedence
+				if err = l.swapLink(expectedSymlinkPath.String(), targetPath); err == nil {
+					l.record(Event{Kind: EventReplaced, Target: targetPath})
+					l.record(Event{Kind: EventLinkCreated, Source: sourcePath.String(), Link: Link{Path: targetPath, Text: expectedSymlinkPath.String(), Layer: l.layer}})
+				} else {
+					l.logError(name, newPathError(sourcePath.String(), targetPath, err))
+				}
+				continue
 			}
-		} else {
-			newSymlinkPath := sourcePath
-			if sourceSymlinkPath != nil {
-				newSymlinkPath = sourceSymlinkPath
-
-				if sourcePath[0] == ".." && sourceSymlinkPath[0] == ".." {
-					//	It becomes very tricky here. We have
-					//	  ../../bar/foo symlinked to ../xxx/yyy. We
-					//	  can't just use ../xxx/yyy. We have to use
-					//	  ../../bar/foo/../xxx/yyy.
-					basePath := sourcePath
-					var minBaseLen int
-					for i, p := range basePath {
-						if p != ".. " {
-							minBaseLen = i
-							break
-						}
-					}
-
-					// Remove extra ".." when possible
-					sourceSegments := sourceSymlinkPath
-					for sourceSegments[0] == ".." && len(basePath) > minBaseLen {
-						basePath = basePath[0 : len(basePath)-1]
-						if len(sourceSegments) == 1 {
-							sourceSegments = []string{"."}
-						}
-						sourceSegments = sourceSegments[1:]
+			l.record(Event{Kind: EventLinkMismatch, Source: sourcePath.String(), Link: existingLink, Expected: expectedSymlinkPath.String()})
+			l.logPrintf("%s: %s", name, existingSymlinkPath)
+			if create, err := l.makeRoom(targetPath, ConflictMismatchedLink); err != nil {
+				return err
+			} else if !create {
+				continue
+			}
+			err = l.replaceLink(expectedSymlinkPath.String(), targetPath)
+		} else if err = l.symlink(expectedSymlinkPath.String(), targetPath); os.IsExist(err) {
+			if info, lstatErr := l.lstatTarget(targetPath); lstatErr == nil && l.mode == ModeStaged && l.ownsStaged(info, sourcePath, targetPath) {
+				// The staged changes have been committed or undone since the file was written
+				if err = l.swapLink(expectedSymlinkPath.String(), targetPath); err == nil {
+					l.record(Event{Kind: EventReplaced, Target: targetPath})
+					if !l.dryRun {
+						l.stagedRecord.forget(targetPath)
 					}
-					newSymlinkPath = append(basePath, sourceSegments...)
 				}
+			} else if lstatErr == nil {
+				reason := ConflictFileForLink
+				if info.IsDir() {
+					reason = ConflictDirectoryForLink
+				}
+				l.addConflict(name, targetPath, reason)
+				if create, err := l.makeRoom(targetPath, reason); err != nil {
+					return err
+				} else if !create {
+					continue
+				}
+				err = l.replaceLink(expectedSymlinkPath.String(), targetPath)
 			}
-			if err = os.Symlink(newSymlinkPath.String(), name); err != nil {
-				l.logError(name, err)
-			}
 		}
+		if err != nil {
+			l.logError(name, newPathError(sourcePath.String(), targetPath, err))
+		} else {
+			l.record(Event{Kind: EventLinkCreated, Source: sourcePath.String(), Link: Link{Path: targetPath, Text: expectedSymlinkPath.String(), Layer: l.layer}})
+		}
+	}
+
+	if l.mode == ModeStaged {
+		present := make(map[string]bool, len(children))
+		for _, name := range children {
+			present[name] = true
+		}
+		if err := l.writeDeletedStaged(sourceDirPath, present, targetDirPath, baseDepth); err != nil {
+			return err
+		}
+	}
+
+	if l.prune && targetDir != nil {
+		linked := make(map[string]bool, len(children))
+		for _, name := range children {
+			linked[name] = !skipped[name]
+		}
+		l.pruneDirectory(targetDirPath, sourceDirName, linked, false)
+	}
+	return wait(tasks)
+}
+
+// linkText returns the text of the link to create for the source entry at sourcePath, which is
+// itself a link to sourceSymlinkPath if that is not nil.
+func linkText(sourcePath, sourceSymlinkPath path) path {
+	if sourceSymlinkPath == nil {
+		return sourcePath
+	}
+	if sourcePath[0] != ".." || sourceSymlinkPath[0] != ".." {
+		return sourceSymlinkPath
+	}
+
+	//	It becomes very tricky here. We have
+	//	  ../../bar/foo symlinked to ../xxx/yyy. We
+	//	  can't just use ../xxx/yyy. We have to use
+	//	  ../../bar/foo/../xxx/yyy.
+	basePath := sourcePath
+	var minBaseLen int
+	for i, p := range basePath {
+		if p != ".. " {
+			minBaseLen = i
+			break
+		}
+	}
+
+	// Remove extra ".." when possible
+	sourceSegments := sourceSymlinkPath
+	for sourceSegments[0] == ".." && len(basePath) > minBaseLen {
+		basePath = basePath[0 : len(basePath)-1]
+		if len(sourceSegments) == 1 {
+			sourceSegments = []string{"."}
+		}
+		sourceSegments = sourceSegments[1:]
+	}
+	// Copy so that the source path's backing array, which may be shared with its parent, is not overwritten
+	return append(append(path{}, basePath...), sourceSegments...)
+}
+
+// addConflict records and logs an entry in the target tree that is in the way.
+func (l *directoryLinker) addConflict(name, targetPath string, reason ConflictReason) {
+	l.record(Event{Kind: EventConflict, Target: targetPath, Reason: reason})
+	l.logPrintf("%s: %s", name, reason)
+}
+
+// symlink creates a link, or in a dry run, checks whether the link could be created.
+func (l *directoryLinker) symlink(oldname, newname string) error {
+	if !l.dryRun {
+		return os.Symlink(oldname, newname)
+	}
+	if _, err := l.lstatTarget(newname); err == nil {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: syscall.EEXIST}
+	} else if !os.IsNotExist(err) {
+		return err
 	}
 	return nil
 }
 
-func isRevInfo(name string) bool {
-	return name == ".git" || name == ".hg" || name == "BigKeeper" || name == "RCS" || name == "SCCS" || name == "CVS" || name == "CVS.adm" || name == ".svn"
+// skipReason returns why the source entry at sourcePath should not be linked, or "" if it should be
+// linked.  info may be nil if the entry is known not to be a directory, unless lstatAll is set.
+func (l *directoryLinker) skipReason(sourcePath path, info os.FileInfo, baseDepth int) SkipReason {
+	relPath := sourcePath.List()[baseDepth:]
+	if skip, reason := l.filter.Skip(relPath, info); skip {
+		return reason
+	}
+	if l.gitFilter != nil {
+		if skip, reason := l.gitFilter.Skip(relPath, info); skip {
+			return reason
+		}
+	}
+	if l.ignoreFiles != nil {
+		if skip, reason := l.ignoreFiles.Skip(relPath, info); skip {
+			return reason
+		}
+	}
+	return ""
 }
 
-func readlink(p path) path {
-	if src, err := os.Readlink(p.String()); err == nil {
+func readlink(name string) path {
+	if src, err := os.Readlink(name); err == nil {
 		srcPath, _ := newPath(src)
 		return srcPath
 	} else {
@@ -0,0 +1,850 @@
+package lndir
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type discardLogger struct{}
+
+func (discardLogger) Printf(format string, v ...interface{}) {}
+func (discardLogger) Println(v ...interface{})               {}
+
+// makeTree creates the given files (and any parent directories) below a new temporary directory
+func makeTree(t *testing.T, files ...string) string {
+	dir, err := ioutil.TempDir("", "lndir-test")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	for _, f := range files {
+		name := filepath.Join(dir, f)
+		if !assert.NoError(t, os.MkdirAll(filepath.Dir(name), 0777)) {
+			t.FailNow()
+		}
+		if !assert.NoError(t, ioutil.WriteFile(name, []byte(f), 0666)) {
+			t.FailNow()
+		}
+	}
+	return dir
+}
+
+func TestLndirDoesNotChangeWorkingDirectory(t *testing.T) {
+	source := makeTree(t, "a", "dir1/b", "dir1/dir2/c")
+	defer os.RemoveAll(source)
+
+	cwd, err := os.Getwd()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	var wg sync.WaitGroup
+	targets := make([]string, 8)
+	for i := range targets {
+		targets[i] = makeTree(t)
+		defer os.RemoveAll(targets[i])
+		wg.Add(1)
+		go func(target string) {
+			defer wg.Done()
+			assert.NoError(t, Lndir(source, target, Config{Silent: true, Logger: discardLogger{}}))
+		}(targets[i])
+	}
+	wg.Wait()
+
+	after, err := os.Getwd()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, cwd, after)
+
+	for _, target := range targets {
+		link, err := os.Readlink(filepath.Join(target, "dir1", "dir2", "c"))
+		assert.NoError(t, err)
+		assert.Equal(t, filepath.Join(source, "dir1", "dir2", "c"), link)
+	}
+}
+
+func TestLndirRelativeSourceIsRelativeToTarget(t *testing.T) {
+	root := makeTree(t, "src/a", "src/dir1/b", "dst/.keep")
+	defer os.RemoveAll(root)
+
+	if !assert.NoError(t, Lndir(filepath.Join("..", "src"), filepath.Join(root, "dst"), Config{Silent: true, Logger: discardLogger{}})) {
+		t.FailNow()
+	}
+
+	link, err := os.Readlink(filepath.Join(root, "dst", "dir1", "b"))
+	assert.NoError(t, err)
+	assert.Equal(t, "../../src/dir1/b", link)
+}
+
+func TestLndirContextStopsWhenCanceled(t *testing.T) {
+	source := makeTree(t, "a", "dir1/b")
+	defer os.RemoveAll(source)
+	target := makeTree(t)
+	defer os.RemoveAll(target)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := LndirContext(ctx, source, target, Config{Silent: true, Logger: discardLogger{}})
+	assert.True(t, errors.Is(err, context.Canceled))
+
+	children, _ := ioutil.ReadDir(target)
+	assert.Empty(t, children)
+}
+
+func TestLndirContextResult(t *testing.T) {
+	source := makeTree(t, "a", "a~", "dir1/b", "dir1/ignored", ".gitignore", ".git/config")
+	defer os.RemoveAll(source)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(source, ".gitignore"), []byte("ignored\n"), 0666))
+	target := makeTree(t)
+	defer os.RemoveAll(target)
+	assert.NoError(t, os.Symlink("elsewhere", filepath.Join(target, ".gitignore")))
+
+	result, err := LndirContext(context.Background(), source, target, Config{Silent: true, UseGitignore: true, Logger: discardLogger{}})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	assert.Equal(t, []Link{
+		{Path: filepath.Join(target, "a"), Text: filepath.Join(source, "a")},
+		{Path: filepath.Join(target, "dir1", "b"), Text: filepath.Join(source, "dir1", "b")},
+	}, sortedLinks(result.CreatedLinks))
+	assert.Equal(t, []string{filepath.Join(target, "dir1")}, result.CreatedDirectories)
+	assert.Equal(t, []MismatchedLink{{
+		Link:     Link{Path: filepath.Join(target, ".gitignore"), Text: "elsewhere"},
+		Expected: filepath.Join(source, ".gitignore"),
+	}}, result.MismatchedLinks)
+	sort.Slice(result.Skipped, func(i, j int) bool { return result.Skipped[i].Path < result.Skipped[j].Path })
+	assert.Equal(t, []SkippedEntry{
+		{Path: filepath.Join(source, ".git"), Reason: SkipRevInfo},
+		{Path: filepath.Join(source, "a~"), Reason: SkipBackup},
+		{Path: filepath.Join(source, "dir1", "ignored"), Reason: SkipGitignore},
+	}, result.Skipped)
+	assert.Empty(t, result.Errors)
+
+	result, err = LndirContext(context.Background(), source, target, Config{Silent: true, UseGitignore: true, Logger: discardLogger{}})
+	assert.NoError(t, err)
+	assert.Empty(t, result.CreatedLinks)
+	assert.Len(t, result.ExistingLinks, 2)
+}
+
+func sortedLinks(links []Link) []Link {
+	sort.Slice(links, func(i, j int) bool { return links[i].Path < links[j].Path })
+	return links
+}
+
+func TestLndirContextDryRun(t *testing.T) {
+	source := makeTree(t, "a", "b", "dir1/c")
+	defer os.RemoveAll(source)
+	target := makeTree(t, "b")
+	defer os.RemoveAll(target)
+
+	result, err := LndirContext(context.Background(), source, target, Config{Silent: true, DryRun: true, Logger: discardLogger{}})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	assert.Equal(t, []string{filepath.Join(target, "dir1")}, result.CreatedDirectories)
+	assert.Equal(t, []Link{
+		{Path: filepath.Join(target, "a"), Text: filepath.Join(source, "a")},
+		{Path: filepath.Join(target, "dir1", "c"), Text: filepath.Join(source, "dir1", "c")},
+	}, sortedLinks(result.CreatedLinks))
+	assert.Equal(t, []Conflict{{Path: filepath.Join(target, "b"), Reason: ConflictFileForLink}}, result.Conflicts)
+	assert.Empty(t, result.Errors)
+
+	children, _ := ioutil.ReadDir(target)
+	assert.Len(t, children, 1)
+}
+
+func TestLndirContextPrune(t *testing.T) {
+	source := makeTree(t, "a", "dir1/b", "dir1/c", "dir2/d")
+	defer os.RemoveAll(source)
+	assert.NoError(t, os.MkdirAll(filepath.Join(source, "dir3", "empty"), 0777))
+	target := makeTree(t)
+	defer os.RemoveAll(target)
+
+	config := Config{Silent: true, UseGitignore: true, Logger: discardLogger{}}
+	_, err := LndirContext(context.Background(), source, target, config)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	assert.NoError(t, os.Remove(filepath.Join(source, "a")))
+	assert.NoError(t, os.RemoveAll(filepath.Join(source, "dir2")))
+	assert.NoError(t, os.RemoveAll(filepath.Join(source, "dir3", "empty")))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(source, "dir1", ".gitignore"), []byte("b\n"), 0666))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(target, "real-file"), nil, 0666))
+	assert.NoError(t, os.Symlink("/nonexistent", filepath.Join(target, "foreign-link")))
+
+	config.Prune = true
+	result, err := LndirContext(context.Background(), source, target, config)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	sort.Strings(result.RemovedLinks)
+	assert.Equal(t, []string{
+		filepath.Join(target, "a"),
+		filepath.Join(target, "dir1", "b"),
+		filepath.Join(target, "dir2", "d"),
+	}, result.RemovedLinks)
+	sort.Strings(result.RemovedDirectories)
+	// The empty directory was already empty, but its source directory is gone
+	assert.Equal(t, []string{filepath.Join(target, "dir2"), filepath.Join(target, "dir3", "empty")}, result.RemovedDirectories)
+
+	for _, name := range []string{"real-file", "foreign-link", "dir1/c", "dir1/.gitignore", "dir3"} {
+		_, err := os.Lstat(filepath.Join(target, name))
+		assert.NoError(t, err, name)
+	}
+	for _, name := range []string{"a", "dir1/b", "dir2", "dir3/empty"} {
+		_, err := os.Lstat(filepath.Join(target, name))
+		assert.True(t, os.IsNotExist(err), name)
+	}
+}
+
+func TestUnlndir(t *testing.T) {
+	source := makeTree(t, "a", "dir1/b", "dir2/c", "dir2/sub/d")
+	defer os.RemoveAll(source)
+	target := makeTree(t)
+	defer os.RemoveAll(target)
+
+	config := Config{Silent: true, Logger: discardLogger{}}
+	_, err := LndirContext(context.Background(), source, target, config)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(target, "dir1", "real-file"), nil, 0666))
+	assert.NoError(t, os.Symlink("/nonexistent", filepath.Join(target, "foreign-link")))
+
+	result, err := Unlndir(source, target, config)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	sort.Strings(result.RemovedLinks)
+	assert.Equal(t, []string{
+		filepath.Join(target, "a"),
+		filepath.Join(target, "dir1", "b"),
+		filepath.Join(target, "dir2", "c"),
+		filepath.Join(target, "dir2", "sub", "d"),
+	}, result.RemovedLinks)
+	sort.Strings(result.RemovedDirectories)
+	assert.Equal(t, []string{filepath.Join(target, "dir2"), filepath.Join(target, "dir2", "sub")}, result.RemovedDirectories)
+	sort.Strings(result.Kept)
+	assert.Equal(t, []string{filepath.Join(target, "dir1", "real-file"), filepath.Join(target, "foreign-link")}, result.Kept)
+	assert.Empty(t, result.Errors)
+
+	for _, name := range []string{"dir1/real-file", "foreign-link"} {
+		_, err := os.Lstat(filepath.Join(target, name))
+		assert.NoError(t, err, name)
+	}
+	for _, name := range []string{"a", "dir1/b", "dir2"} {
+		_, err := os.Lstat(filepath.Join(target, name))
+		assert.True(t, os.IsNotExist(err), name)
+	}
+	// The source tree is untouched
+	for _, name := range []string{"a", "dir1/b", "dir2/c", "dir2/sub/d"} {
+		_, err := os.Lstat(filepath.Join(source, name))
+		assert.NoError(t, err, name)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	source := makeTree(t, "a", "b", "c", "d", "dir1/e")
+	defer os.RemoveAll(source)
+	target := makeTree(t)
+	defer os.RemoveAll(target)
+
+	config := Config{Silent: true, Logger: discardLogger{}}
+	_, err := LndirContext(context.Background(), source, target, config)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	drift, err := Verify(source, target, config)
+	assert.NoError(t, err)
+	assert.True(t, drift.IsClean())
+
+	assert.NoError(t, os.Remove(filepath.Join(target, "a")))
+	assert.NoError(t, os.MkdirAll(filepath.Join(source, "dir2"), 0777))
+	assert.NoError(t, os.Remove(filepath.Join(target, "b")))
+	assert.NoError(t, os.Symlink("elsewhere", filepath.Join(target, "b")))
+	assert.NoError(t, os.Remove(filepath.Join(source, "c")))
+	assert.NoError(t, os.Remove(filepath.Join(target, "d")))
+	assert.NoError(t, os.Mkdir(filepath.Join(target, "d"), 0777))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(target, "dir1", "extra"), nil, 0666))
+
+	drift, err = Verify(source, target, config)
+	assert.NoError(t, err)
+	assert.False(t, drift.IsClean())
+	assert.Equal(t, []Link{{Path: filepath.Join(target, "a"), Text: filepath.Join(source, "a")}}, drift.MissingLinks)
+	assert.Equal(t, []string{filepath.Join(target, "dir2")}, drift.MissingDirectories)
+	assert.Equal(t, []MismatchedLink{{Link: Link{Path: filepath.Join(target, "b"), Text: "elsewhere"}, Expected: filepath.Join(source, "b")}}, drift.MismatchedLinks)
+	assert.Equal(t, []string{filepath.Join(target, "c")}, drift.StaleLinks)
+	assert.Equal(t, []string{filepath.Join(target, "dir1", "extra")}, drift.ExtraFiles)
+	assert.Equal(t, []Conflict{{Path: filepath.Join(target, "d"), Reason: ConflictDirectoryForLink}}, drift.Conflicts)
+	assert.Empty(t, drift.Errors)
+
+	// Verify does not change the target
+	_, err = os.Lstat(filepath.Join(target, "a"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Lstat(filepath.Join(target, "c"))
+	assert.NoError(t, err)
+}
+
+func TestLndirContextConflictPolicy(t *testing.T) {
+	source := makeTree(t, "a", "b", "dir1/c")
+	defer os.RemoveAll(source)
+
+	setup := func() string {
+		target := makeTree(t, "b", "dir1")
+		assert.NoError(t, os.Symlink("elsewhere", filepath.Join(target, "a")))
+		return target
+	}
+
+	t.Run("skip", func(t *testing.T) {
+		target := setup()
+		defer os.RemoveAll(target)
+		result, err := LndirContext(context.Background(), source, target, Config{Silent: true, Logger: discardLogger{}})
+		assert.NoError(t, err)
+		assert.Empty(t, result.CreatedLinks)
+		assert.Empty(t, result.Replaced)
+		link, _ := os.Readlink(filepath.Join(target, "a"))
+		assert.Equal(t, "elsewhere", link)
+	})
+
+	t.Run("replace", func(t *testing.T) {
+		target := setup()
+		defer os.RemoveAll(target)
+		// An entry with the name the old temporary files had is not touched
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(target, "b"+tmpSuffix), []byte("keep"), 0666))
+		result, err := LndirContext(context.Background(), source, target, Config{Silent: true, OnConflict: ConflictPolicyReplace, Logger: discardLogger{}})
+		assert.NoError(t, err)
+		contents, _ := ioutil.ReadFile(filepath.Join(target, "b"+tmpSuffix))
+		assert.Equal(t, "keep", string(contents))
+		children, _ := ioutil.ReadDir(target)
+		assert.Len(t, children, 4)
+		sort.Strings(result.Replaced)
+		assert.Equal(t, []string{filepath.Join(target, "a"), filepath.Join(target, "b"), filepath.Join(target, "dir1")}, result.Replaced)
+		for _, name := range []string{"a", "b", "dir1/c"} {
+			link, _ := os.Readlink(filepath.Join(target, name))
+			assert.Equal(t, filepath.Join(source, name), link)
+		}
+	})
+
+	t.Run("backup", func(t *testing.T) {
+		target := setup()
+		defer os.RemoveAll(target)
+		// Existing backups are kept
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(target, "b.orig"), []byte("older"), 0666))
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(target, "b.1.orig"), []byte("old"), 0666))
+		_, err := LndirContext(context.Background(), source, target, Config{Silent: true, OnConflict: ConflictPolicyBackup, BackupSuffix: ".orig", Logger: discardLogger{}})
+		assert.NoError(t, err)
+		link, _ := os.Readlink(filepath.Join(target, "a.orig"))
+		assert.Equal(t, "elsewhere", link)
+		for name, expected := range map[string]string{"b.orig": "older", "b.1.orig": "old", "b.2.orig": "b"} {
+			contents, _ := ioutil.ReadFile(filepath.Join(target, name))
+			assert.Equal(t, expected, string(contents), name)
+		}
+		link, _ = os.Readlink(filepath.Join(target, "b"))
+		assert.Equal(t, filepath.Join(source, "b"), link)
+	})
+
+	t.Run("error", func(t *testing.T) {
+		target := setup()
+		defer os.RemoveAll(target)
+		_, err := LndirContext(context.Background(), source, target, Config{Silent: true, OnConflict: ConflictPolicyError, Logger: discardLogger{}})
+		assert.Error(t, err)
+	})
+}
+
+type recordingLogger struct {
+	lines []string
+}
+
+func (r *recordingLogger) Printf(format string, v ...interface{}) {
+	r.lines = append(r.lines, fmt.Sprintf(format, v...))
+}
+
+func (r *recordingLogger) Println(v ...interface{}) {
+	r.lines = append(r.lines, fmt.Sprintln(v...))
+}
+
+func TestLndirContextConcurrencyMatchesSequentialWalk(t *testing.T) {
+	var files []string
+	for i := 0; i < 5; i++ {
+		for j := 0; j < 5; j++ {
+			files = append(files, fmt.Sprintf("dir%d/sub%d/file", i, j), fmt.Sprintf("dir%d/file%d", i, j))
+		}
+	}
+	source := makeTree(t, files...)
+	defer os.RemoveAll(source)
+
+	run := func(concurrency int) (*Result, []string) {
+		target := makeTree(t, "dir2/sub3/file", "dir4/file1")
+		defer os.RemoveAll(target)
+		logger := &recordingLogger{}
+		result, err := LndirContext(context.Background(), source, target, Config{Silent: true, Concurrency: concurrency, Logger: logger})
+		assert.NoError(t, err)
+
+		// Make the results comparable across target directories
+		for i := range result.CreatedLinks {
+			result.CreatedLinks[i].Path = strings.TrimPrefix(result.CreatedLinks[i].Path, target)
+		}
+		for i := range result.CreatedDirectories {
+			result.CreatedDirectories[i] = strings.TrimPrefix(result.CreatedDirectories[i], target)
+		}
+		for i := range result.Conflicts {
+			result.Conflicts[i].Path = strings.TrimPrefix(result.Conflicts[i].Path, target)
+		}
+		return result, logger.lines
+	}
+
+	sequentialResult, sequentialLog := run(1)
+	concurrentResult, concurrentLog := run(8)
+	assert.Len(t, sequentialResult.CreatedLinks, len(files)-2)
+	assert.Len(t, sequentialResult.Conflicts, 2)
+	assert.Equal(t, sequentialResult, concurrentResult)
+	assert.Equal(t, sequentialLog, concurrentLog)
+}
+
+func TestLndirContextMode(t *testing.T) {
+	source := makeTree(t, "a", "dir1/b")
+	defer os.RemoveAll(source)
+	assert.NoError(t, os.Symlink("a", filepath.Join(source, "link")))
+
+	for _, mode := range []Mode{ModeHardlink, ModeCopy, ModeReflink} {
+		t.Run(string(mode), func(t *testing.T) {
+			target := makeTree(t)
+			defer os.RemoveAll(target)
+			result, err := LndirContext(context.Background(), source, target, Config{Silent: true, Mode: mode, Logger: discardLogger{}})
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			assert.Len(t, result.CreatedLinks, 3)
+			assert.Empty(t, result.Errors)
+
+			for _, name := range []string{"a", "dir1/b"} {
+				info, err := os.Lstat(filepath.Join(target, name))
+				if assert.NoError(t, err) {
+					assert.True(t, info.Mode().IsRegular())
+				}
+				contents, _ := ioutil.ReadFile(filepath.Join(target, name))
+				assert.Equal(t, name, string(contents))
+			}
+			sourceInfo, _ := os.Stat(filepath.Join(source, "a"))
+			targetInfo, _ := os.Stat(filepath.Join(target, "a"))
+			assert.Equal(t, mode == ModeHardlink, os.SameFile(sourceInfo, targetInfo))
+
+			// Links in the source are still reproduced as links
+			link, _ := os.Readlink(filepath.Join(target, "link"))
+			assert.Equal(t, "a", link)
+
+			result, err = LndirContext(context.Background(), source, target, Config{Silent: true, Mode: mode, Logger: discardLogger{}})
+			assert.NoError(t, err)
+			assert.Empty(t, result.CreatedLinks)
+			assert.Len(t, result.ExistingLinks, 3)
+
+			assert.NoError(t, os.Remove(filepath.Join(target, "a")))
+			assert.NoError(t, ioutil.WriteFile(filepath.Join(target, "a"), []byte("changed"), 0666))
+			result, err = LndirContext(context.Background(), source, target, Config{Silent: true, Mode: mode, OnConflict: ConflictPolicyReplace, Logger: discardLogger{}})
+			assert.NoError(t, err)
+			assert.Equal(t, []Conflict{{Path: filepath.Join(target, "a"), Reason: ConflictModifiedFile}}, result.Conflicts)
+			contents, _ := ioutil.ReadFile(filepath.Join(target, "a"))
+			assert.Equal(t, "a", string(contents))
+		})
+	}
+}
+
+func TestLndirContextFold(t *testing.T) {
+	source := makeTree(t, "a", "dir1/b", "dir1/sub/c", "dir2/d", "dir2/d~")
+	defer os.RemoveAll(source)
+	target := makeTree(t)
+	defer os.RemoveAll(target)
+
+	result, err := LndirContext(context.Background(), source, target, Config{Silent: true, Fold: true, Logger: discardLogger{}})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, []Link{
+		{Path: filepath.Join(target, "a"), Text: filepath.Join(source, "a")},
+		{Path: filepath.Join(target, "dir1"), Text: filepath.Join(source, "dir1")},
+		{Path: filepath.Join(target, "dir2", "d"), Text: filepath.Join(source, "dir2", "d")},
+	}, sortedLinks(result.CreatedLinks))
+	assert.Equal(t, []string{filepath.Join(target, "dir2")}, result.CreatedDirectories)
+	assert.Empty(t, result.Errors)
+
+	result, err = LndirContext(context.Background(), source, target, Config{Silent: true, Fold: true, Logger: discardLogger{}})
+	assert.NoError(t, err)
+	assert.Empty(t, result.CreatedLinks)
+	assert.Len(t, result.ExistingLinks, 3)
+
+	// Something in the folded directory is now excluded, so it has to be unfolded
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(source, "dir1", "sub", "c~"), nil, 0666))
+	for _, dryRun := range []bool{true, false} {
+		result, err = LndirContext(context.Background(), source, target, Config{Silent: true, Fold: true, DryRun: dryRun, Logger: discardLogger{}})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{filepath.Join(target, "dir1")}, result.Unfolded)
+		assert.Equal(t, []string{filepath.Join(target, "dir1"), filepath.Join(target, "dir1", "sub")}, result.CreatedDirectories)
+		assert.Equal(t, []Link{
+			{Path: filepath.Join(target, "dir1", "b"), Text: filepath.Join(source, "dir1", "b")},
+			{Path: filepath.Join(target, "dir1", "sub", "c"), Text: filepath.Join(source, "dir1", "sub", "c")},
+		}, sortedLinks(result.CreatedLinks))
+		assert.Empty(t, result.Conflicts)
+		assert.Empty(t, result.Errors)
+	}
+	info, err := os.Lstat(filepath.Join(target, "dir1"))
+	if assert.NoError(t, err) {
+		assert.True(t, info.IsDir())
+	}
+}
+
+func TestLndirContextFoldScansEachDirectoryOnce(t *testing.T) {
+	// The junk file deep down means that none of the directories above it can be folded
+	source := makeTree(t, "a/b/c/d/e", "a/b/c/d/e~")
+	defer os.RemoveAll(source)
+	target := makeTree(t)
+	defer os.RemoveAll(target)
+
+	checked := map[string]int{}
+	filter := Filters{DefaultFilter(Config{}), FilterFunc(func(relPath []string, info os.FileInfo) (bool, SkipReason) {
+		checked[strings.Join(relPath, "/")]++
+		return false, ""
+	})}
+	_, err := LndirContext(context.Background(), source, target, Config{Silent: true, Fold: true, Filter: filter, Logger: discardLogger{}})
+	assert.NoError(t, err)
+	// Once while deciding whether a can be folded and once while linking a/b
+	assert.Equal(t, 2, checked["a/b/c"])
+}
+
+func TestLndirMulti(t *testing.T) {
+	base := makeTree(t, "a", "b", "dir1/c", "dir1/d", "e/f")
+	defer os.RemoveAll(base)
+	patch := makeTree(t, "b", "dir1/d", "dir2/g", "e")
+	defer os.RemoveAll(patch)
+	target := makeTree(t)
+	defer os.RemoveAll(target)
+
+	expected := []Link{
+		{Path: filepath.Join(target, "a"), Text: filepath.Join(base, "a"), Layer: 0},
+		{Path: filepath.Join(target, "b"), Text: filepath.Join(patch, "b"), Layer: 1},
+		{Path: filepath.Join(target, "dir1", "c"), Text: filepath.Join(base, "dir1", "c"), Layer: 0},
+		{Path: filepath.Join(target, "dir1", "d"), Text: filepath.Join(patch, "dir1", "d"), Layer: 1},
+		{Path: filepath.Join(target, "dir2"), Text: filepath.Join(patch, "dir2"), Layer: 1},
+		{Path: filepath.Join(target, "e"), Text: filepath.Join(patch, "e"), Layer: 1},
+	}
+	for _, dryRun := range []bool{true, false} {
+		result, err := LndirMulti(context.Background(), []string{base, patch}, target, Config{Silent: true, Fold: true, DryRun: dryRun, Logger: discardLogger{}})
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		assert.Equal(t, expected, sortedLinks(result.CreatedLinks))
+		assert.Equal(t, []string{filepath.Join(target, "dir1")}, result.CreatedDirectories)
+		assert.Len(t, result.Skipped, 3)
+		assert.Empty(t, result.Conflicts)
+	}
+
+	result, err := LndirMulti(context.Background(), []string{base, patch}, target, Config{Silent: true, Fold: true, Logger: discardLogger{}})
+	assert.NoError(t, err)
+	assert.Empty(t, result.CreatedLinks)
+	assert.Equal(t, expected, sortedLinks(result.ExistingLinks))
+	assert.Empty(t, result.MismatchedLinks)
+
+	// Once the patch no longer has a file, the base's is linked instead, and a new directory in the
+	// base unfolds the patch's
+	assert.NoError(t, os.Remove(filepath.Join(patch, "b")))
+	assert.NoError(t, os.MkdirAll(filepath.Join(base, "dir2"), 0777))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(base, "dir2", "h"), nil, 0666))
+	result, err = LndirMulti(context.Background(), []string{base, patch}, target, Config{Silent: true, Fold: true, Logger: discardLogger{}})
+	assert.NoError(t, err)
+	assert.Equal(t, []Link{
+		{Path: filepath.Join(target, "b"), Text: filepath.Join(base, "b"), Layer: 0},
+		{Path: filepath.Join(target, "dir2", "g"), Text: filepath.Join(patch, "dir2", "g"), Layer: 1},
+		{Path: filepath.Join(target, "dir2", "h"), Text: filepath.Join(base, "dir2", "h"), Layer: 0},
+	}, sortedLinks(result.CreatedLinks))
+	assert.Equal(t, []string{filepath.Join(target, "b")}, result.Replaced)
+	assert.Equal(t, []string{filepath.Join(target, "dir2")}, result.Unfolded)
+	assert.Empty(t, result.MismatchedLinks)
+	assert.Empty(t, result.Conflicts)
+	assert.Empty(t, result.Errors)
+}
+
+func TestLndirContextGitExcludes(t *testing.T) {
+	source := makeTree(t, "global-file", "global-kept", "info-file", "info-kept", "plain", ".git/info/exclude", ".gitignore")
+	defer os.RemoveAll(source)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(source, ".git", "info", "exclude"), []byte("info-*\n"), 0666))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(source, ".gitignore"), []byte("!info-kept\n!global-kept\n"), 0666))
+	home := makeTree(t, "config/git/ignore", "custom-ignore", ".gitconfig")
+	defer os.RemoveAll(home)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(home, "config", "git", "ignore"), []byte("global-*\n"), 0666))
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(home, "config"))
+
+	linked := func(config Config) []string {
+		target := makeTree(t)
+		defer os.RemoveAll(target)
+		config.Silent, config.Logger = true, discardLogger{}
+		result, err := LndirContext(context.Background(), source, target, config)
+		assert.NoError(t, err)
+		var names []string
+		for _, link := range result.CreatedLinks {
+			names = append(names, filepath.Base(link.Path))
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	assert.Equal(t, []string{".gitignore", "global-file", "global-kept", "plain"}, linked(Config{UseGitInfoExclude: true}))
+	assert.Equal(t, []string{".gitignore", "info-file", "info-kept", "plain"}, linked(Config{UseGlobalGitignore: true}))
+	assert.Equal(t, []string{".gitignore", "global-kept", "info-kept", "plain"}, linked(Config{UseGitignore: true, UseGitInfoExclude: true, UseGlobalGitignore: true}))
+
+	// core.excludesFile replaces the default global file
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(home, ".gitconfig"), []byte("[core]\n\texcludesFile = \"~/custom-ignore\" # comment\n"), 0666))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(home, "custom-ignore"), []byte("plain\n"), 0666))
+	assert.Equal(t, []string{".gitignore", "global-file", "global-kept", "info-file", "info-kept"}, linked(Config{UseGlobalGitignore: true}))
+}
+
+func TestLndirContextFilter(t *testing.T) {
+	source := makeTree(t, "keep", "keep~", "big/file", "small/file", ".git/HEAD")
+	defer os.RemoveAll(source)
+	target := makeTree(t)
+	defer os.RemoveAll(target)
+
+	const skipBig SkipReason = "big"
+	var seen []string
+	filter := Filters{DefaultFilter(Config{}), FilterFunc(func(relPath []string, info os.FileInfo) (bool, SkipReason) {
+		seen = append(seen, filepath.Join(relPath...))
+		return info.IsDir() && relPath[len(relPath)-1] == "big", skipBig
+	})}
+	result, err := LndirContext(context.Background(), source, target, Config{Silent: true, Logger: discardLogger{}, Filter: filter})
+	assert.NoError(t, err)
+
+	var linked []string
+	for _, link := range result.CreatedLinks {
+		linked = append(linked, filepath.Base(link.Path))
+	}
+	sort.Strings(linked)
+	assert.Equal(t, []string{"file", "keep"}, linked)
+	reasons := map[string]SkipReason{}
+	for _, skipped := range result.Skipped {
+		reasons[filepath.Base(skipped.Path)] = skipped.Reason
+	}
+	assert.Equal(t, map[string]SkipReason{"keep~": SkipBackup, ".git": SkipRevInfo, "big": skipBig}, reasons)
+	// Entries skipped by an earlier filter are not passed to later ones
+	sort.Strings(seen)
+	assert.Equal(t, []string{"big", "keep", "small", filepath.Join("small", "file")}, seen)
+}
+
+func TestLndirContextExcludeInclude(t *testing.T) {
+	source := makeTree(t, "main.go", "node_modules/pkg/index.js", "bazel-out/file", "build/out.o", "build/keep.txt", "src/build")
+	defer os.RemoveAll(source)
+	target := makeTree(t)
+	defer os.RemoveAll(target)
+
+	config := Config{Silent: true, Logger: discardLogger{}, Exclude: []string{"node_modules/", "bazel-*", "build"}, Include: []string{"build/keep.txt", "src/build"}}
+	result, err := LndirContext(context.Background(), source, target, config)
+	assert.NoError(t, err)
+
+	var linked []string
+	for _, link := range result.CreatedLinks {
+		rel, _ := filepath.Rel(target, link.Path)
+		linked = append(linked, rel)
+	}
+	sort.Strings(linked)
+	// Excluding a directory excludes everything in it, as it does in git
+	assert.Equal(t, []string{"main.go", filepath.Join("src", "build")}, linked)
+	for _, skipped := range result.Skipped {
+		assert.Equal(t, SkipExcluded, skipped.Reason)
+	}
+	assert.Len(t, result.Skipped, 3)
+}
+
+func TestLndirContextIgnoreFile(t *testing.T) {
+	source := makeTree(t, "a/fixtures/big", "a/src.go", "a/.lndirignore", "b/fixtures/small", ".lndirignore")
+	defer os.RemoveAll(source)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(source, ".lndirignore"), []byte("# fixtures are only needed by tests\nfixtures/\n"), 0666))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(source, "a", ".lndirignore"), []byte("!fixtures/\nfixtures/big\n"), 0666))
+
+	linked := func(config Config) []string {
+		target := makeTree(t)
+		defer os.RemoveAll(target)
+		config.Silent, config.Logger = true, discardLogger{}
+		result, err := LndirContext(context.Background(), source, target, config)
+		assert.NoError(t, err)
+		var names []string
+		for _, link := range result.CreatedLinks {
+			rel, _ := filepath.Rel(target, link.Path)
+			names = append(names, filepath.ToSlash(rel))
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	// Patterns in subdirectories override those above them
+	assert.Equal(t, []string{"a/src.go"}, linked(Config{}))
+	assert.Equal(t, []string{".lndirignore", "a/.lndirignore", "a/src.go"}, linked(Config{LinkIgnoreFiles: true}))
+	assert.Equal(t, []string{".lndirignore", "a/.lndirignore", "a/fixtures/big", "a/src.go", "b/fixtures/small"}, linked(Config{NoIgnoreFile: true}))
+	assert.Equal(t, []string{".lndirignore", "a/.lndirignore", "a/fixtures/big", "a/src.go", "b/fixtures/small"}, linked(Config{IgnoreFile: ".other"}))
+}
+
+func TestLndirContextJunkNames(t *testing.T) {
+	source := makeTree(t, "a~", "a.swp", ".DS_Store", "Thumbs.db", ".jj/repo", ".git/HEAD", "_build/out", "plain")
+	defer os.RemoveAll(source)
+
+	skipped := func(config Config) map[string]SkipReason {
+		target := makeTree(t)
+		defer os.RemoveAll(target)
+		config.Silent, config.Logger = true, discardLogger{}
+		result, err := LndirContext(context.Background(), source, target, config)
+		assert.NoError(t, err)
+		reasons := map[string]SkipReason{}
+		for _, entry := range result.Skipped {
+			reasons[filepath.Base(entry.Path)] = entry.Reason
+		}
+		return reasons
+	}
+
+	assert.Equal(t, map[string]SkipReason{"a~": SkipBackup, "a.swp": SkipBackup, ".DS_Store": SkipOSJunk, "Thumbs.db": SkipOSJunk, ".jj": SkipRevInfo, ".git": SkipRevInfo},
+		skipped(Config{OSJunk: OSJunkAlways}))
+	assert.Equal(t, map[string]SkipReason{"_build": SkipRevInfo},
+		skipped(Config{OSJunk: OSJunkNever, JunkNames: []string{}, RevInfoNames: []string{"_*"}}))
+	assert.Equal(t, map[string]SkipReason{"Thumbs.db": SkipOSJunk},
+		skipped(Config{OSJunk: OSJunkAlways, OSJunkNames: []string{"Thumbs.db"}, JunkNames: []string{}, WithRevInfo: true}))
+}
+
+func TestLndirContextGitignoreIsReadLazily(t *testing.T) {
+	source := makeTree(t, ".gitignore", "node_modules/.gitignore/x", "node_modules/pkg/index.js", "src/.gitignore", "src/a.go", "src/a.o")
+	defer os.RemoveAll(source)
+	target := makeTree(t)
+	defer os.RemoveAll(target)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(source, ".gitignore"), []byte("node_modules/\n"), 0666))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(source, "src", ".gitignore"), []byte("*.o\n"), 0666))
+
+	// The unreadable .gitignore in the ignored directory is never read
+	result, err := LndirContext(context.Background(), source, target, Config{Silent: true, Logger: discardLogger{}, UseGitignore: true})
+	assert.NoError(t, err)
+	assert.Empty(t, result.Errors)
+	var linked []string
+	for _, link := range result.CreatedLinks {
+		rel, _ := filepath.Rel(target, link.Path)
+		linked = append(linked, filepath.ToSlash(rel))
+	}
+	sort.Strings(linked)
+	assert.Equal(t, []string{".gitignore", "src/.gitignore", "src/a.go"}, linked)
+
+	// Without the .gitignore at the top, it is read when the directory is reached
+	assert.NoError(t, os.Remove(filepath.Join(source, ".gitignore")))
+	target = makeTree(t)
+	defer os.RemoveAll(target)
+	result, err = LndirContext(context.Background(), source, target, Config{Silent: true, Logger: discardLogger{}, UseGitignore: true})
+	assert.NoError(t, err)
+	assert.Len(t, result.Errors, 1)
+}
+
+func TestLndirContextCallbacks(t *testing.T) {
+	source := makeTree(t, "a", "b~", "keep/c", "veto/d", "vetoed-file", "broken/.gitignore/x")
+	defer os.RemoveAll(source)
+	target := makeTree(t)
+	defer os.RemoveAll(target)
+
+	var dirs, links, skips []string
+	var errs []error
+	config := Config{
+		Silent:       true,
+		Logger:       discardLogger{},
+		UseGitignore: true,
+		OnDir: func(event DirEvent) bool {
+			dirs = append(dirs, filepath.Base(event.Source))
+			return filepath.Base(event.Target) != "veto"
+		},
+		OnLink: func(event LinkEvent) bool {
+			links = append(links, filepath.Base(event.Source))
+			assert.Equal(t, event.Source, event.Text)
+			return filepath.Base(event.Target) != "vetoed-file"
+		},
+		OnSkip:  func(entry SkippedEntry) { skips = append(skips, filepath.Base(entry.Path)+": "+string(entry.Reason)) },
+		OnError: func(err error) { errs = append(errs, err) },
+	}
+	result, err := LndirContext(context.Background(), source, target, config)
+	assert.NoError(t, err)
+
+	sort.Strings(dirs)
+	sort.Strings(links)
+	sort.Strings(skips)
+	// The .gitignore directory cannot be read as a .gitignore file, so it is linked like any other
+	assert.Equal(t, []string{".gitignore", "broken", "keep", "veto"}, dirs)
+	assert.Equal(t, []string{"a", "c", "vetoed-file", "x"}, links)
+	assert.Equal(t, []string{"b~: backup file", "veto: vetoed", "vetoed-file: vetoed"}, skips)
+	assert.Len(t, skips, len(result.Skipped))
+	assert.Equal(t, result.Errors, errs)
+	assert.Len(t, errs, 1)
+
+	_, err = os.Lstat(filepath.Join(target, "veto"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Lstat(filepath.Join(target, "vetoed-file"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestLndirContextOnEvent(t *testing.T) {
+	source := makeTree(t, "a", "dir/b")
+	defer os.RemoveAll(source)
+	assert.NoError(t, os.Symlink("a", filepath.Join(source, "link")))
+	target := makeTree(t)
+	defer os.RemoveAll(target)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(target, "a"), nil, 0666))
+
+	var events []Event
+	config := Config{Silent: true, Logger: discardLogger{}, OnEvent: func(e Event) { events = append(events, e) }}
+	result, err := LndirContext(context.Background(), source, target, config)
+	assert.NoError(t, err)
+
+	sort.Slice(events, func(i, j int) bool { return events[i].Target < events[j].Target })
+	assert.Equal(t, []Event{
+		{Kind: EventConflict, Target: filepath.Join(target, "a"), Reason: ConflictFileForLink},
+		{Kind: EventDirCreated, Source: filepath.Join(source, "dir"), Target: filepath.Join(target, "dir")},
+		{Kind: EventLinkCreated, Source: filepath.Join(source, "dir", "b"), Target: filepath.Join(target, "dir", "b"), Link: Link{Path: filepath.Join(target, "dir", "b"), Text: filepath.Join(source, "dir", "b")}},
+		// The source of a link reproducing a link in the source is that link, not what it points to
+		{Kind: EventLinkCreated, Source: filepath.Join(source, "link"), Target: filepath.Join(target, "link"), Link: Link{Path: filepath.Join(target, "link"), Text: "a"}},
+	}, events)
+	assert.Len(t, result.CreatedLinks, 2)
+}
+
+func TestLndirContextCallbacksPreventFolding(t *testing.T) {
+	source := makeTree(t, "dir/a", "dir/sub/b")
+	defer os.RemoveAll(source)
+	target := makeTree(t)
+	defer os.RemoveAll(target)
+
+	var links []string
+	config := Config{
+		Silent: true,
+		Logger: discardLogger{},
+		Fold:   true,
+		OnLink: func(event LinkEvent) bool {
+			links = append(links, filepath.Base(event.Source))
+			return filepath.Base(event.Source) != "a"
+		},
+	}
+	_, err := LndirContext(context.Background(), source, target, config)
+	assert.NoError(t, err)
+
+	sort.Strings(links)
+	assert.Equal(t, []string{"a", "b"}, links)
+	info, err := os.Lstat(filepath.Join(target, "dir"))
+	if assert.NoError(t, err) {
+		assert.True(t, info.IsDir())
+	}
+	_, err = os.Lstat(filepath.Join(target, "dir", "a"))
+	assert.True(t, os.IsNotExist(err))
+	link, _ := os.Readlink(filepath.Join(target, "dir", "sub", "b"))
+	assert.Equal(t, filepath.Join(source, "dir", "sub", "b"), link)
+}
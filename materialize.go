@@ -0,0 +1,186 @@
+package lndir
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"strconv"
+)
+
+// Mode determines how files are reproduced in the target tree.
+type Mode string
+
+const (
+	// ModeSymlink creates symbolic links to the source files.  This is the default.
+	ModeSymlink Mode = "symlink"
+	// ModeHardlink creates hard links to the source files, which must be on the same file system.
+	ModeHardlink Mode = "hardlink"
+	// ModeCopy copies the source files.
+	ModeCopy Mode = "copy"
+	// ModeReflink clones the source files where the file system supports it, and copies them otherwise.
+	ModeReflink Mode = "reflink"
+	// ModeStaged creates symbolic links to files whose contents are staged in git, and writes the staged
+	// contents of the others, so that the target matches what would be committed.  Links and files it
+	// created earlier are replaced when the staged state of a file changes; the files it wrote are
+	// listed in StagedRecordName at the top of the target so that other files are never replaced
+	// without Config.OnConflict.  Files with unresolved merge conflicts are skipped.  It implies
+	// Config.GitTracked.
+	ModeStaged Mode = "staged"
+)
+
+// Set implements flag.Value.
+func (m *Mode) Set(value string) error {
+	switch mode := Mode(value); mode {
+	case ModeSymlink, ModeHardlink, ModeCopy, ModeReflink, ModeStaged:
+		*m = mode
+		return nil
+	}
+	return fmt.Errorf("unknown mode %q", value)
+}
+
+func (m *Mode) String() string {
+	if m == nil || *m == "" {
+		return string(ModeSymlink)
+	}
+	return string(*m)
+}
+
+// materialize reproduces the source file at sourceName at targetPath according to the mode.  It
+// only returns errors that should abort the walk.
+func (l *directoryLinker) materialize(name string, sourcePath path, sourceName, targetPath string) error {
+	sourceInfo, err := os.Stat(sourceName)
+	if err != nil {
+		l.logError(name, newPathError(sourcePath.String(), targetPath, err))
+		return nil
+	}
+
+	link := Link{Path: targetPath, Text: sourceName, Mode: l.mode, Layer: l.layer}
+	isCurrent := func(existing os.FileInfo) bool { return l.isMaterialized(existing, sourceInfo) }
+	place := func(name string) error { return l.place(sourceName, sourceInfo, name) }
+	return l.reproduce(name, sourcePath, link, isCurrent, place)
+}
+
+// reproduce creates a file described by link in the target, using place to create it at a given
+// name, unless isCurrent returns true for the existing entry.  Other existing entries are conflicts,
+// except for those ModeStaged created itself, which are replaced.  It only returns errors that should
+// abort the walk.
+func (l *directoryLinker) reproduce(name string, sourcePath path, link Link, isCurrent func(os.FileInfo) bool, place func(string) error) error {
+	targetPath := link.Path
+	replace := false
+	if existing, err := l.lstatTarget(targetPath); err == nil {
+		if isCurrent(existing) {
+			l.record(Event{Kind: EventLinkExists, Source: sourcePath.String(), Link: link})
+			return nil
+		}
+		if l.mode == ModeStaged && l.ownsStaged(existing, sourcePath, targetPath) {
+			replace = true
+			l.record(Event{Kind: EventReplaced, Target: targetPath})
+		} else {
+			reason := ConflictModifiedFile
+			if existing.IsDir() {
+				reason = ConflictDirectoryForLink
+			} else if existing.Mode()&os.ModeSymlink != 0 {
+				reason = ConflictLinkForFile
+			}
+			l.addConflict(name, targetPath, reason)
+			if create, err := l.makeRoom(targetPath, reason); err != nil {
+				return err
+			} else if !create {
+				return nil
+			}
+			replace = l.onConflict == ConflictPolicyReplace
+		}
+	} else if !os.IsNotExist(err) {
+		l.logError(name, newPathError(sourcePath.String(), targetPath, err))
+		return nil
+	}
+
+	if !l.dryRun {
+		if err := replaceWith(targetPath, replace, place); err != nil {
+			l.logError(name, newPathError(sourcePath.String(), targetPath, err))
+			return nil
+		}
+	}
+	l.record(Event{Kind: EventLinkCreated, Source: sourcePath.String(), Link: link})
+	return nil
+}
+
+// replaceWith calls place to create a new entry at targetPath.  If replace is true, the entry is
+// created under a temporary name in the same directory and renamed over whatever is at targetPath.
+// Like ioutil.TempFile, it relies on place failing if the name already exists, and tries another
+// name in that case, so that entries it did not create are never removed.
+func replaceWith(targetPath string, replace bool, place func(string) error) error {
+	if !replace {
+		return place(targetPath)
+	}
+	var tmpName string
+	for try := 0; ; try++ {
+		tmpName = targetPath + tmpSuffix + strconv.Itoa(int(rand.Int31()))
+		err := place(tmpName)
+		if err == nil {
+			break
+		}
+		if !os.IsExist(err) || try == maxTempTries {
+			return err
+		}
+	}
+	if err := os.Rename(tmpName, targetPath); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return nil
+}
+
+// isMaterialized returns true if the existing target entry is already what the mode would create.
+// Copies are assumed to be current if their size and modification time match the source.
+func (l *directoryLinker) isMaterialized(existing, sourceInfo os.FileInfo) bool {
+	if l.mode == ModeHardlink {
+		return os.SameFile(existing, sourceInfo)
+	}
+	return existing.Mode().IsRegular() && existing.Size() == sourceInfo.Size() && existing.ModTime().Equal(sourceInfo.ModTime())
+}
+
+// place creates the hard link, copy or clone at name.
+func (l *directoryLinker) place(sourceName string, sourceInfo os.FileInfo, name string) error {
+	switch l.mode {
+	case ModeHardlink:
+		return os.Link(sourceName, name)
+	case ModeReflink:
+		return copyFile(sourceName, name, sourceInfo, true)
+	default:
+		return copyFile(sourceName, name, sourceInfo, false)
+	}
+}
+
+// copyFile copies sourceName to a new file, preserving its permissions and modification time.  If clone
+// is true, the file is cloned if possible.
+func copyFile(sourceName, name string, sourceInfo os.FileInfo, clone bool) (err error) {
+	in, err := os.Open(sourceName)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, sourceInfo.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Chtimes(name, sourceInfo.ModTime(), sourceInfo.ModTime())
+		}
+		if err != nil {
+			os.Remove(name)
+		}
+	}()
+
+	if clone && reflink(out, in) == nil {
+		return nil
+	}
+	_, err = io.Copy(out, in)
+	return err
+}
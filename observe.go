@@ -0,0 +1,133 @@
+package lndir
+
+// DirEvent describes a source directory that Lndir is about to enter.
+type DirEvent struct {
+	// Source is the source path, written as it would appear in a link
+	Source string
+	// Target is the corresponding directory in the target tree, which may not exist yet
+	Target string
+	// Layer is the index of the source in the list passed to LndirMulti
+	Layer int
+}
+
+// LinkEvent describes a source file that Lndir is about to link.
+type LinkEvent struct {
+	// Source is the source path, written as it would appear in a link
+	Source string
+	// Target is the name of the link in the target tree, which may already exist
+	Target string
+	// Text is the text of the link for ModeSymlink, including links in the source tree, which are
+	// reproduced as links in every mode
+	Text string
+	Mode Mode
+	// Layer is the index of the source in the list passed to LndirMulti
+	Layer int
+}
+
+// EventKind names what happened to an entry in the target tree.  Each kind corresponds to a field of
+// Result.
+type EventKind string
+
+const (
+	EventDirCreated   EventKind = "dir_created"
+	EventLinkCreated  EventKind = "link_created"
+	EventLinkExists   EventKind = "link_exists"
+	EventLinkMismatch EventKind = "link_mismatch"
+	EventConflict     EventKind = "conflict"
+	EventReplaced     EventKind = "replaced"
+	EventLinkUnfolded EventKind = "link_unfolded"
+	EventLinkRemoved  EventKind = "link_removed"
+	EventDirRemoved   EventKind = "dir_removed"
+	EventKept         EventKind = "kept"
+)
+
+// Event describes an entry as it is added to the Result.  Skipped entries and errors are reported to
+// Config.OnSkip and Config.OnError instead.
+type Event struct {
+	Kind EventKind
+	// Source is the source entry for created directories and for links, written as it would appear in
+	// a link.  It is empty for the other kinds.
+	Source string
+	// Target is the entry in the target tree, which is Link.Path for links
+	Target string
+	// Link is set for EventLinkCreated, EventLinkExists and EventLinkMismatch
+	Link Link
+	// Expected is the text a mismatched link should have
+	Expected string
+	// Reason is set for EventConflict
+	Reason ConflictReason
+}
+
+// record adds the entry described by e to the result and calls Config.OnEvent.
+func (l *directoryLinker) record(e Event) {
+	if e.Target == "" {
+		e.Target = e.Link.Path
+	}
+	r := l.result
+	switch e.Kind {
+	case EventDirCreated:
+		r.CreatedDirectories = append(r.CreatedDirectories, e.Target)
+	case EventLinkCreated:
+		r.CreatedLinks = append(r.CreatedLinks, e.Link)
+	case EventLinkExists:
+		r.ExistingLinks = append(r.ExistingLinks, e.Link)
+	case EventLinkMismatch:
+		r.MismatchedLinks = append(r.MismatchedLinks, MismatchedLink{Link: e.Link, Expected: e.Expected})
+	case EventConflict:
+		r.Conflicts = append(r.Conflicts, Conflict{Path: e.Target, Reason: e.Reason})
+	case EventReplaced:
+		r.Replaced = append(r.Replaced, e.Target)
+	case EventLinkUnfolded:
+		r.Unfolded = append(r.Unfolded, e.Target)
+	case EventLinkRemoved:
+		r.RemovedLinks = append(r.RemovedLinks, e.Target)
+	case EventDirRemoved:
+		r.RemovedDirectories = append(r.RemovedDirectories, e.Target)
+	case EventKept:
+		r.Kept = append(r.Kept, e.Target)
+	}
+	if l.onEvent != nil {
+		onEvent := l.onEvent
+		l.notify(func() { onEvent(e) })
+	}
+}
+
+// allowDir calls Config.OnDir for the source directory at sourcePath and returns false if it vetoed
+// the directory, in which case it has been reported as skipped.
+func (l *directoryLinker) allowDir(sourcePath path, targetPath string) bool {
+	if l.onDir == nil || l.onDir(DirEvent{Source: sourcePath.String(), Target: targetPath, Layer: l.layer}) {
+		return true
+	}
+	l.skip(sourcePath, SkipVetoed)
+	return false
+}
+
+// allowLink calls Config.OnLink for the source file at sourcePath, which is a link to
+// sourceSymlinkPath if that is not nil, and returns false if it vetoed the file, in which case it
+// has been reported as skipped.
+func (l *directoryLinker) allowLink(sourcePath, sourceSymlinkPath path, targetPath string) bool {
+	if l.onLink == nil {
+		return true
+	}
+	event := LinkEvent{Source: sourcePath.String(), Target: targetPath, Mode: l.mode, Layer: l.layer}
+	if sourceSymlinkPath != nil {
+		event.Mode = ModeSymlink
+	}
+	if event.Mode == ModeSymlink {
+		event.Text = linkText(sourcePath, sourceSymlinkPath).String()
+	}
+	if l.onLink(event) {
+		return true
+	}
+	l.skip(sourcePath, SkipVetoed)
+	return false
+}
+
+// skip records that the source entry at sourcePath was not linked and calls Config.OnSkip.
+func (l *directoryLinker) skip(sourcePath path, reason SkipReason) {
+	l.result.addSkipped(sourcePath, reason)
+	if l.onSkip != nil {
+		entry, onSkip := l.result.Skipped[len(l.result.Skipped)-1], l.onSkip
+		l.notify(func() { onSkip(entry) })
+	}
+}
@@ -0,0 +1,155 @@
+package lndir
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// LndirMulti merges several source trees into one shadow tree.  Where more than one source has an
+// entry with the same path, the one from the source that comes later in fromPaths is linked and the
+// others are skipped with SkipOverridden, except that directories present in several sources are
+// merged.  Links to the same entry in other sources that are in the way are replaced without regard to
+// Config.OnConflict, so that repeated runs and changes to the sources keep the tree in sync.
+//
+// Sources are processed from last to first, and each Link in the Result records the index of the
+// source it came from.  Otherwise, LndirMulti behaves like LndirContext.
+func LndirMulti(ctx context.Context, fromPaths []string, toPath string, config Config) (*Result, error) {
+	result := &Result{}
+	if len(fromPaths) == 0 {
+		return result, userError{errors.New("no source directories")}
+	}
+
+	o := &overlay{targetRoot: toPath, claims: map[string]bool{}, created: map[string]bool{}}
+	for _, fromPath := range fromPaths {
+		sourcePath, err := newPath(fromPath)
+		if err != nil {
+			return result, err
+		}
+		// Relative source paths are relative to the target directory
+		sourceName := resolve(toPath, sourcePath)
+		root, err := filepath.Abs(sourceName)
+		if err != nil {
+			return result, err
+		}
+		o.sourceNames = append(o.sourceNames, sourceName)
+		o.roots = append(o.roots, root)
+	}
+
+	for layer := len(fromPaths) - 1; layer >= 0; layer-- {
+		if err := lndir(ctx, fromPaths[layer], toPath, config, result, o, layer); err != nil {
+			return result, err
+		}
+	}
+	if config.CollectErrors && len(result.Errors) > 0 {
+		return result, EntryErrors(result.Errors)
+	}
+	return result, nil
+}
+
+// overlay is shared by the linkers for each source passed to LndirMulti.  Its methods may be called
+// on a nil overlay, which has a single source.
+type overlay struct {
+	targetRoot string
+	// sourceNames are the source directories, resolved against the target directory
+	sourceNames []string
+	// roots are the absolute source directories
+	roots []string
+
+	mu sync.Mutex
+	// claims maps target paths already handled by a source that takes precedence to whether they are
+	// directories
+	claims map[string]bool
+	// created holds the directories a dry run would have created
+	created map[string]bool
+}
+
+// claim records that the entry at targetPath is being handled by the current source.  It returns
+// false if a source that takes precedence has already handled it, unless both are directories.
+func (o *overlay) claim(targetPath string, isDir bool) bool {
+	if o == nil {
+		return true
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if claimedDir, claimed := o.claims[targetPath]; claimed {
+		return claimedDir && isDir
+	}
+	o.claims[targetPath] = isDir
+	return true
+}
+
+// create returns true the first time it is called for targetPath, so that directories are only
+// reported once in a dry run.
+func (o *overlay) create(targetPath string) bool {
+	if o == nil {
+		return true
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.created[targetPath] {
+		return false
+	}
+	o.created[targetPath] = true
+	return true
+}
+
+// layerOf returns the index of the source the link at name points into, or -1 if there is none.
+func (o *overlay) layerOf(name string) int {
+	if o == nil {
+		return -1
+	}
+	if destination, ok := linkDestination(name); ok {
+		for i, root := range o.roots {
+			if isWithin(destination, root) {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// sourceNamesFor returns the directories in every source other than layer that correspond to
+// targetPath.
+func (o *overlay) sourceNamesFor(layer int, targetPath string) []string {
+	if o == nil {
+		return nil
+	}
+	relative := strings.TrimPrefix(targetPath, o.targetRoot)
+	var names []string
+	for i, sourceName := range o.sourceNames {
+		if i != layer {
+			names = append(names, filepath.Join(sourceName, relative))
+		}
+	}
+	return names
+}
+
+// isShared returns true if any source other than layer has a directory corresponding to targetPath,
+// in which case it cannot be folded.
+func (o *overlay) isShared(layer int, targetPath string) bool {
+	for _, name := range o.sourceNamesFor(layer, targetPath) {
+		if info, err := os.Stat(name); err == nil && info.IsDir() {
+			return true
+		}
+	}
+	return false
+}
+
+// linksToOtherSource returns true if the link at targetPath points to the corresponding entry in a
+// source other than layer.
+func (o *overlay) linksToOtherSource(layer int, targetPath string) bool {
+	destination, ok := linkDestination(targetPath)
+	if !ok {
+		return false
+	}
+	for _, name := range o.sourceNamesFor(layer, targetPath) {
+		if abs, err := filepath.Abs(name); err == nil && destination == abs {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,139 @@
+package lndir
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+)
+
+// When directories are processed concurrently, each linker records its output and results in a
+// sequence of segments instead of writing them directly.  A segment ends where a subdirectory was
+// handed to another goroutine, so replaying the segments and the subdirectories' own segments in
+// order reproduces the output of a sequential walk.
+type segment struct {
+	result Result
+	stdout bytes.Buffer
+	logger bufferedLogger
+	// hooks holds the calls to Config.OnSkip, Config.OnError and Config.OnEvent
+	hooks []func()
+	// child is the subdirectory processed after this segment, if any
+	child *subdirTask
+}
+
+type subdirTask struct {
+	linker *directoryLinker
+	done   chan struct{}
+	err    error
+}
+
+type bufferedLogger struct {
+	calls []func(Logger)
+}
+
+func (b *bufferedLogger) Printf(format string, v ...interface{}) {
+	b.calls = append(b.calls, func(logger Logger) { logger.Printf(format, v...) })
+}
+
+func (b *bufferedLogger) Println(v ...interface{}) {
+	b.calls = append(b.calls, func(logger Logger) { logger.Println(v...) })
+}
+
+// startSegment directs the linker's output and results to a new segment.
+func (l *directoryLinker) startSegment() {
+	seg := &segment{}
+	l.segments = append(l.segments, seg)
+	l.result = &seg.result
+	l.stdout = &seg.stdout
+	l.logger = &seg.logger
+}
+
+// replay waits for any subdirectories still being processed and writes everything recorded by the
+// linker to the given destinations.
+func (l *directoryLinker) replay(result *Result, logger Logger, stdout io.Writer) {
+	for _, seg := range l.segments {
+		result.merge(&seg.result)
+		for _, call := range seg.logger.calls {
+			call(logger)
+		}
+		for _, hook := range seg.hooks {
+			hook()
+		}
+		stdout.Write(seg.stdout.Bytes())
+		if seg.child != nil {
+			<-seg.child.done
+			seg.child.linker.replay(result, logger, stdout)
+		}
+	}
+}
+
+// notify calls hook, which calls one of the hooks in Config that only report what happened, or records
+// it to be replayed in order if directories are being processed concurrently.
+func (l *directoryLinker) notify(hook func()) {
+	if len(l.segments) == 0 {
+		hook()
+		return
+	}
+	seg := l.segments[len(l.segments)-1]
+	seg.hooks = append(seg.hooks, hook)
+}
+
+// walkSubdir calls process for a subdirectory, on another goroutine if a worker is available.  Subdirectories
+// processed concurrently are added to tasks so that the caller can wait for them.
+func (l *directoryLinker) walkSubdir(ctx context.Context, tasks *[]*subdirTask, process func(*directoryLinker) error) error {
+	if workers := l.workers; workers != nil {
+		select {
+		case workers <- struct{}{}:
+			child := *l
+			child.segments = nil
+			child.startSegment()
+			task := &subdirTask{linker: &child, done: make(chan struct{})}
+
+			l.segments[len(l.segments)-1].child = task
+			l.startSegment()
+			*tasks = append(*tasks, task)
+
+			go func() {
+				defer close(task.done)
+				defer func() { <-workers }()
+				task.err = child.handleSubdirError(ctx, process(&child))
+			}()
+			return nil
+		default:
+			// Fall back to processing the subdirectory on this goroutine, which is always possible
+		}
+	}
+	return l.handleSubdirError(ctx, process(l))
+}
+
+// handleSubdirError logs err unless it should abort the walk, in which case it is returned.
+func (l *directoryLinker) handleSubdirError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	// Only cancellation and conflicts under ConflictPolicyError abort the walk.  A conflict also
+	// cancels the directories being processed concurrently.
+	var conflict *ConflictError
+	if errors.As(err, &conflict) {
+		if l.abort != nil {
+			l.abort.set(err)
+		}
+		return err
+	}
+	if ctx.Err() != nil {
+		return err
+	}
+	l.logError("", err)
+	return nil
+}
+
+// wait waits for the given subdirectories and returns the first error that should abort the walk.
+func wait(tasks []*subdirTask) error {
+	for _, task := range tasks {
+		<-task.done
+		if task.err != nil {
+			return task.err
+		}
+	}
+	return nil
+}
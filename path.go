@@ -1,6 +1,9 @@
 package lndir
 
-import "path/filepath"
+import (
+	"path/filepath"
+	"strings"
+)
 
 type path []string
 
@@ -15,3 +18,21 @@ func (p path) String() string {
 func (p path) List() []string {
 	return []string(p)
 }
+
+// resolve returns the file system name of p, interpreting relative paths as
+// relative to dir.
+func resolve(dir string, p path) string {
+	if p.isAbs() {
+		return p.String()
+	}
+	return join(dir, p.String())
+}
+
+// join appends name to dir.  Unlike filepath.Join, it does not clean the result,
+// since removing ".." lexically is wrong when dir traverses a symlink.
+func join(dir, name string) string {
+	if strings.HasSuffix(dir, string(filepath.Separator)) {
+		return dir + name
+	}
+	return dir + string(filepath.Separator) + name
+}
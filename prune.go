@@ -0,0 +1,142 @@
+package lndir
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// pruneDirectory removes stale links to the source tree from targetDirPath, which corresponds to the
+// source directory sourceDirName.  linked maps the names of the entries in the source directory to
+// whether they were linked; it is nil if the source directory was not read.  Links to entries that
+// were not linked are removed, as are dangling links into the source tree.  If filtered is true, the
+// whole directory has been excluded, so every link into the source tree is removed.  Real files are
+// never removed.
+//
+// pruneDirectory returns true if the directory is left empty and either something was removed from
+// it, it mirrors a source directory, or its source directory no longer exists.  When unlinking, the
+// source tree may be gone altogether, so only the first two count.
+func (l *directoryLinker) pruneDirectory(targetDirPath, sourceDirName string, linked map[string]bool, filtered bool) bool {
+	f, err := os.Open(targetDirPath)
+	if err != nil {
+		l.logError(targetDirPath, newPathError("", targetDirPath, err))
+		return false
+	}
+	names, err := f.Readdirnames(0)
+	f.Close()
+	if err != nil {
+		l.logError(targetDirPath, newPathError("", targetDirPath, err))
+		return false
+	}
+	sort.Strings(names)
+
+	removed := 0
+	for _, name := range names {
+		isLinked, inSource := linked[name]
+		if isLinked {
+			continue
+		}
+		if l.stagedRecord != nil && join(targetDirPath, name) == l.stagedRecord.name {
+			// The staged record is neither kept nor removed
+			continue
+		}
+		excluded := filtered || inSource
+
+		targetPath := join(targetDirPath, name)
+		sourceName := join(sourceDirName, name)
+		info, err := os.Lstat(targetPath)
+		if err != nil {
+			l.logError(targetPath, newPathError("", targetPath, err))
+			continue
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			// Links to other sources of an overlay are left to the linkers for those sources
+			if layer := l.overlay.layerOf(targetPath); layer >= 0 && layer != l.layer {
+				continue
+			}
+			if !l.pointsIntoSource(targetPath) && !mirrorsLink(targetPath, sourceName) {
+				l.record(Event{Kind: EventKept, Target: targetPath})
+				continue
+			}
+			if _, err := os.Stat(targetPath); !excluded && !os.IsNotExist(err) {
+				l.record(Event{Kind: EventKept, Target: targetPath})
+				continue
+			}
+			if l.remove(targetPath) {
+				l.record(Event{Kind: EventLinkRemoved, Target: targetPath})
+				removed++
+			}
+		} else if info.IsDir() {
+			if l.pruneDirectory(targetPath, sourceName, nil, excluded) && l.remove(targetPath) {
+				l.record(Event{Kind: EventDirRemoved, Target: targetPath})
+				removed++
+			}
+		} else {
+			l.record(Event{Kind: EventKept, Target: targetPath})
+		}
+	}
+
+	if removed < len(names) {
+		return false
+	}
+	if removed > 0 {
+		return true
+	}
+	sourceDir, err := os.Stat(sourceDirName)
+	if os.IsNotExist(err) {
+		return !l.unlinking
+	}
+	return err == nil && sourceDir.IsDir()
+}
+
+// mirrorsLink returns true if the link at name is a copy of a link in the source tree at sourceName,
+// as Lndir creates for links with relative text.
+func mirrorsLink(name, sourceName string) bool {
+	text, err := os.Readlink(name)
+	if err != nil {
+		return false
+	}
+	sourceText, err := os.Readlink(sourceName)
+	return err == nil && text == sourceText
+}
+
+// pointsIntoSource returns true if the link at name refers to a path within the source tree.
+func (l *directoryLinker) pointsIntoSource(name string) bool {
+	destination, ok := linkDestination(name)
+	return ok && isWithin(destination, l.sourceRoot)
+}
+
+// linkDestination returns the absolute path the link at name refers to, without following any
+// further links.
+func linkDestination(name string) (string, bool) {
+	text, err := os.Readlink(name)
+	if err != nil {
+		return "", false
+	}
+	if !filepath.IsAbs(text) {
+		text = filepath.Join(filepath.Dir(name), text)
+	}
+	if text, err = filepath.Abs(text); err != nil {
+		return "", false
+	}
+	return text, true
+}
+
+// isWithin returns true if name is root or below it.
+func isWithin(name, root string) bool {
+	return name == root || strings.HasPrefix(name, root+string(filepath.Separator))
+}
+
+// remove deletes name unless this is a dry run, returning true if it was, or would have been, removed.
+func (l *directoryLinker) remove(name string) bool {
+	if l.dryRun {
+		return true
+	}
+	if err := os.Remove(name); err != nil {
+		l.logError(name, newPathError("", name, err))
+		return false
+	}
+	return true
+}
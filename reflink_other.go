@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package lndir
+
+import (
+	"errors"
+	"os"
+)
+
+// reflink is only supported on Linux.
+func reflink(dst, src *os.File) error {
+	return errors.New("reflink is not supported on this platform")
+}
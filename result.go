@@ -0,0 +1,121 @@
+package lndir
+
+// SkipReason describes why an entry in the source tree was not linked.
+type SkipReason string
+
+const (
+	// SkipBackup is used for backup and editor files listed in Config.JunkNames
+	SkipBackup    SkipReason = "backup file"
+	SkipRevInfo   SkipReason = "revision control information"
+	SkipGitignore SkipReason = "gitignore"
+	// SkipOSJunk is used for files listed in Config.OSJunkNames
+	SkipOSJunk    SkipReason = "OS junk"
+	SkipUntracked SkipReason = "not tracked by git"
+	SkipExcluded  SkipReason = "excluded by pattern"
+	// SkipIgnoreFile is used for entries listed in an ignore file and for the ignore files themselves
+	SkipIgnoreFile SkipReason = "lndirignore"
+	// SkipOverridden is used by LndirMulti for entries that a later source also has
+	SkipOverridden SkipReason = "overridden by a later source"
+	// SkipVetoed is used for entries for which Config.OnDir or Config.OnLink returned false
+	SkipVetoed SkipReason = "vetoed"
+	// SkipUnmerged is used by ModeStaged for files with unresolved merge conflicts
+	SkipUnmerged SkipReason = "unmerged"
+
+	// Deprecated: SkipDSStore is the same as SkipOSJunk
+	SkipDSStore = SkipOSJunk
+)
+
+// ConflictReason describes what is in the way of a link or directory in the target tree.
+type ConflictReason string
+
+const (
+	ConflictLinkForDirectory ConflictReason = "is a link instead of a directory"
+	ConflictFileForDirectory ConflictReason = "is a file instead of a directory"
+	ConflictFileForLink      ConflictReason = "is a file instead of a link"
+	ConflictDirectoryForLink ConflictReason = "is a directory instead of a link"
+	ConflictMismatchedLink   ConflictReason = "is a link to somewhere else"
+	ConflictLinkForFile      ConflictReason = "is a link instead of a file"
+	ConflictModifiedFile     ConflictReason = "differs from the source file"
+)
+
+// Conflict describes an existing entry in the target tree that prevented Lndir from creating a link
+// or directory.
+type Conflict struct {
+	Path   string
+	Reason ConflictReason
+}
+
+// Link describes a symbolic link in the target tree.  In modes other than ModeSymlink, it describes a
+// hard link, copy or clone.
+type Link struct {
+	// Path is the name of the link in the target tree
+	Path string
+	// Text is the contents of the link, or the name of the source file in modes other than ModeSymlink.
+	// For files written by ModeStaged, it is the name of the git object that was written.
+	Text string
+	// Mode is how the entry was created, which is empty for symbolic links
+	Mode Mode
+	// Layer is the index of the source the entry came from in the list passed to LndirMulti
+	Layer int
+}
+
+// MismatchedLink describes a link that already existed in the target tree but does not point where
+// Lndir would have pointed it.
+type MismatchedLink struct {
+	Link
+	Expected string
+}
+
+// SkippedEntry describes an entry in the source tree that was deliberately not linked.
+type SkippedEntry struct {
+	// Path is the source path, written as it would appear in a link
+	Path   string
+	Reason SkipReason
+}
+
+// Result describes everything Lndir did, or tried to do, to the target tree.  In a dry run,
+// CreatedLinks and CreatedDirectories list what would have been created and Conflicts and Errors
+// list the operations that would have failed.
+type Result struct {
+	CreatedLinks       []Link
+	CreatedDirectories []string
+	ExistingLinks      []Link
+	MismatchedLinks    []MismatchedLink
+	Skipped            []SkippedEntry
+	Conflicts          []Conflict
+	// Replaced lists existing entries that were replaced or backed up according to Config.OnConflict,
+	// as well as links to other sources replaced by LndirMulti and entries that ModeStaged created
+	// for an earlier staged or unstaged version of a file
+	Replaced []string
+	// Unfolded lists links to folded directories that were replaced with real directories
+	Unfolded []string
+	// RemovedLinks and RemovedDirectories are only populated when pruning or unlinking
+	RemovedLinks       []string
+	RemovedDirectories []string
+	// Kept lists the files and links that were considered for removal while pruning or unlinking, but
+	// were left alone because they are not stale links into the source tree
+	Kept []string
+	// Errors holds failures for individual entries.  Each is or wraps a *PathError, which can be
+	// retrieved with errors.As.  These are not fatal, so they do not cause Lndir to return an error.
+	Errors []error
+}
+
+func (r *Result) addSkipped(p path, reason SkipReason) {
+	r.Skipped = append(r.Skipped, SkippedEntry{Path: p.String(), Reason: reason})
+}
+
+// merge appends everything in other to r.
+func (r *Result) merge(other *Result) {
+	r.CreatedLinks = append(r.CreatedLinks, other.CreatedLinks...)
+	r.CreatedDirectories = append(r.CreatedDirectories, other.CreatedDirectories...)
+	r.ExistingLinks = append(r.ExistingLinks, other.ExistingLinks...)
+	r.MismatchedLinks = append(r.MismatchedLinks, other.MismatchedLinks...)
+	r.Skipped = append(r.Skipped, other.Skipped...)
+	r.Conflicts = append(r.Conflicts, other.Conflicts...)
+	r.Replaced = append(r.Replaced, other.Replaced...)
+	r.Unfolded = append(r.Unfolded, other.Unfolded...)
+	r.RemovedLinks = append(r.RemovedLinks, other.RemovedLinks...)
+	r.RemovedDirectories = append(r.RemovedDirectories, other.RemovedDirectories...)
+	r.Kept = append(r.Kept, other.Kept...)
+	r.Errors = append(r.Errors, other.Errors...)
+}
@@ -0,0 +1,301 @@
+package lndir
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/index"
+)
+
+// stagedChange returns the index entry for the source file at the relative path relPath if the
+// staged contents differ from the file in the working tree at sourceName.
+func (l *directoryLinker) stagedChange(relPath []string, sourceName string) (*index.Entry, bool) {
+	entry, tracked := l.gitFilter.tracked.files[strings.Join(relPath, "/")]
+	if !tracked || !isIndexFile(entry.Mode) {
+		return entry, false
+	}
+	info, err := os.Lstat(sourceName)
+	if err != nil || !info.Mode().IsRegular() {
+		return entry, false
+	}
+	// Like git, trust the size and modification time recorded when the file was staged
+	if uint32(info.Size()) == entry.Size && info.ModTime().Equal(entry.ModifiedAt) {
+		return entry, false
+	}
+	hash, err := fileBlobHash(sourceName)
+	return entry, err == nil && hash != entry.Hash
+}
+
+// ownsStaged returns true if the existing entry at targetPath was created by ModeStaged for the source
+// file at sourcePath: a link to it, made while the file had no staged changes, or a file that the
+// staged record says was written there and that still has the contents written.  Nothing is lost by
+// replacing these.
+func (l *directoryLinker) ownsStaged(existing os.FileInfo, sourcePath path, targetPath string) bool {
+	if existing.Mode()&os.ModeSymlink != 0 {
+		text := l.readlinkTarget(targetPath)
+		return text != nil && equivalent(text, linkText(sourcePath, nil))
+	}
+	if !existing.Mode().IsRegular() {
+		return false
+	}
+	hash, err := fileBlobHash(targetPath)
+	return err == nil && l.stagedRecord.has(targetPath, hash)
+}
+
+// writeStaged writes the staged contents of a file to targetPath.  It only returns errors that should
+// abort the walk.
+func (l *directoryLinker) writeStaged(name string, sourcePath path, entry *index.Entry, targetPath string) error {
+	link := Link{Path: targetPath, Text: entry.Hash.String(), Mode: ModeStaged, Layer: l.layer}
+	isCurrent := func(existing os.FileInfo) bool {
+		if !existing.Mode().IsRegular() {
+			return false
+		}
+		hash, err := fileBlobHash(targetPath)
+		return err == nil && hash == entry.Hash
+	}
+	place := func(name string) error {
+		data, err := l.gitObjects.readBlob(entry.Hash)
+		if err != nil {
+			return err
+		}
+		perm := os.FileMode(0666)
+		if entry.Mode == filemode.Executable {
+			perm = 0777
+		}
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+		if err != nil {
+			return err
+		}
+		if _, err = f.Write(data); err != nil {
+			f.Close()
+			os.Remove(name)
+			return err
+		}
+		if err = f.Close(); err == nil {
+			l.stagedRecord.wrote(targetPath, entry.Hash)
+		}
+		return err
+	}
+	return l.reproduce(name, sourcePath, link, isCurrent, place)
+}
+
+// writeDeletedStaged writes the staged files in the source directory at sourceDirPath that have been
+// deleted from the working tree.  present holds the names of the entries in the working tree.
+func (l *directoryLinker) writeDeletedStaged(sourceDirPath path, present map[string]bool, targetDirPath string, baseDepth int) error {
+	relDir := strings.Join(sourceDirPath.List()[baseDepth:], "/")
+	for _, name := range l.gitFilter.tracked.children[relDir] {
+		if present[name] {
+			continue
+		}
+		if err := l.writeStagedTree(append(sourceDirPath[:len(sourceDirPath):len(sourceDirPath)], name), join(targetDirPath, name), baseDepth); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeStagedTree writes the staged file or directory at sourcePath, which does not exist in the
+// working tree.  Only regular files are written.  Like the entries that do exist, they are subject to
+// the filters and to Config.OnDir and Config.OnLink.
+func (l *directoryLinker) writeStagedTree(sourcePath path, targetPath string, baseDepth int) error {
+	relName := strings.Join(sourcePath.List()[baseDepth:], "/")
+	name := sourcePath[len(sourcePath)-1]
+	entry, isFile := l.gitFilter.tracked.files[relName]
+	if isFile && !isIndexFile(entry.Mode) || !isFile && !l.gitFilter.tracked.dirs[relName] {
+		return nil
+	}
+	if reason := l.skipReason(sourcePath, stagedFileInfo{name: name, entry: entry}, baseDepth); reason != "" {
+		l.skip(sourcePath, reason)
+		return nil
+	}
+	if isFile {
+		if !l.allowLink(sourcePath, nil, targetPath) {
+			return nil
+		}
+		return l.writeStaged(name, sourcePath, entry, targetPath)
+	}
+	if !l.allowDir(sourcePath, targetPath) {
+		return nil
+	}
+
+	if info, err := l.lstatTarget(targetPath); os.IsNotExist(err) {
+		if !l.dryRun {
+			if err := os.Mkdir(targetPath, 0777); err != nil {
+				l.logError(name, newPathError(sourcePath.String(), targetPath, err))
+				return nil
+			}
+		}
+		l.record(Event{Kind: EventDirCreated, Source: sourcePath.String(), Target: targetPath})
+	} else if err != nil {
+		l.logError(name, newPathError(sourcePath.String(), targetPath, err))
+		return nil
+	} else if !info.IsDir() {
+		l.addConflict(name, targetPath, ConflictFileForDirectory)
+		return nil
+	}
+	return l.writeDeletedStaged(sourcePath, nil, targetPath, baseDepth)
+}
+
+// stagedFileInfo describes a staged file, or a directory of staged files if entry is nil, that has
+// been deleted from the working tree, so that it can be passed to filters.
+type stagedFileInfo struct {
+	name  string
+	entry *index.Entry
+}
+
+func (i stagedFileInfo) Name() string { return i.name }
+
+func (i stagedFileInfo) Size() int64 {
+	if i.entry == nil {
+		return 0
+	}
+	return int64(i.entry.Size)
+}
+
+func (i stagedFileInfo) Mode() os.FileMode {
+	if i.entry == nil {
+		return os.ModeDir | 0777
+	}
+	mode, _ := i.entry.Mode.ToOSFileMode()
+	return mode
+}
+
+func (i stagedFileInfo) ModTime() time.Time {
+	if i.entry == nil {
+		return time.Time{}
+	}
+	return i.entry.ModifiedAt
+}
+
+func (i stagedFileInfo) IsDir() bool      { return i.entry == nil }
+func (i stagedFileInfo) Sys() interface{} { return nil }
+
+// StagedRecordName is the name of the file at the top of the target tree in which ModeStaged records
+// the files it wrote.
+const StagedRecordName = ".lndir-staged"
+
+// stagedRecord holds the files that ModeStaged wrote in the target tree, and the blobs written to
+// them, so that later runs only replace files they wrote themselves.  Its methods may be called on a
+// nil stagedRecord, which records nothing.
+type stagedRecord struct {
+	mu sync.Mutex
+	// name is the record file, and root the top of the target tree
+	name, root string
+	// blobs maps paths relative to root, separated by "/", to the blob written there
+	blobs   map[string]plumbing.Hash
+	changed bool
+}
+
+// readStagedRecord reads the record in the target tree at root, which is empty if there is none.
+// Lines that cannot be parsed are dropped.
+func readStagedRecord(root string) (*stagedRecord, error) {
+	r := &stagedRecord{name: join(root, StagedRecordName), root: root, blobs: map[string]plumbing.Hash{}}
+	data, err := ioutil.ReadFile(r.name)
+	if os.IsNotExist(err) {
+		return r, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) < 2 {
+			continue
+		}
+		if hash := plumbing.NewHash(fields[0]); hash.String() == fields[0] {
+			r.blobs[fields[1]] = hash
+		}
+	}
+	return r, nil
+}
+
+func (r *stagedRecord) key(targetPath string) string {
+	rel, err := filepath.Rel(r.root, targetPath)
+	if err != nil {
+		return ""
+	}
+	return filepath.ToSlash(rel)
+}
+
+// has returns true if the blob with the given name was written at targetPath.
+func (r *stagedRecord) has(targetPath string, hash plumbing.Hash) bool {
+	if r == nil {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	written, ok := r.blobs[r.key(targetPath)]
+	return ok && written == hash
+}
+
+// wrote records that the blob with the given name was written at targetPath.
+func (r *stagedRecord) wrote(targetPath string, hash plumbing.Hash) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.blobs[r.key(targetPath)] = hash
+	r.changed = true
+}
+
+// forget removes targetPath from the record.
+func (r *stagedRecord) forget(targetPath string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := r.key(targetPath)
+	if _, ok := r.blobs[key]; ok {
+		delete(r.blobs, key)
+		r.changed = true
+	}
+}
+
+// save writes the record if it changed, replacing the file atomically, or removes the file if
+// nothing is recorded.
+func (r *stagedRecord) save() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.changed {
+		return nil
+	}
+	r.changed = false
+	if len(r.blobs) == 0 {
+		if err := os.Remove(r.name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	keys := make([]string, 0, len(r.blobs))
+	for key := range r.blobs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var data []byte
+	for _, key := range keys {
+		data = append(data, r.blobs[key].String()+" "+key+"\n"...)
+	}
+	return replaceWith(r.name, true, func(name string) error {
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+		if err != nil {
+			return err
+		}
+		if _, err = f.Write(data); err != nil {
+			f.Close()
+			os.Remove(name)
+			return err
+		}
+		return f.Close()
+	})
+}
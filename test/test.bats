@@ -86,3 +86,77 @@ teardown() {
   run $GOLNDIR $PWD/sample-dir $targetdir/missing
   [ "$status" -eq 2 ]
 }
+
+@test "lndir resolves a relative source from the target directory rather than the working directory" {
+  cp -r $PWD/sample-dir $targetdir/sample-dir
+  mkdir -p $targetdir/relative-test-dir
+  run $GOLNDIR -gitignore ../sample-dir $targetdir/relative-test-dir
+  [ "$status" -eq 0 ]
+  [ "$(readlink -n $targetdir/relative-test-dir/included-file)" == "../sample-dir/included-file" ]
+  [ "$(readlink -n $targetdir/relative-test-dir/dir1/included-file)" == "../../sample-dir/dir1/included-file" ]
+  [ ! -e "$targetdir/relative-test-dir/dir1/ignored-file" ]
+}
+
+@test "lndir -n prints the links it would create without creating them" {
+  run $GOLNDIR -n -silent $PWD/sample-dir $targetdir
+  [ "$status" -eq 0 ]
+  echo "$output"
+  [[ "$output" == *"mkdir $targetdir/dir1"* ]]
+  [[ "$output" == *"ln -s $PWD/sample-dir/dir1/included-file $targetdir/dir1/included-file"* ]]
+  [ -z "$(ls -A $targetdir)" ]
+}
+
+@test "lndir unlink removes links to the source and leaves other files" {
+  run $GOLNDIR -silent $PWD/sample-dir $targetdir
+  [ "$status" -eq 0 ]
+  touch $targetdir/dir1/generated-file
+  ln -s /nonexistent $targetdir/foreign-link
+  run $GOLNDIR unlink $PWD/sample-dir $targetdir
+  [ "$status" -eq 0 ]
+  [ "$output" == "kept $targetdir/dir1/generated-file
+kept $targetdir/foreign-link" ]
+  [ -f "$targetdir/dir1/generated-file" ]
+  [ -L "$targetdir/foreign-link" ]
+  [ ! -e "$targetdir/included-file" ]
+  [ ! -e "$targetdir/revinfo-files" ]
+  [ "$(ls -A $targetdir/dir1)" == "generated-file" ]
+}
+
+@test "lndir verify reports whether the target is in sync" {
+  run $GOLNDIR -silent $PWD/sample-dir $targetdir
+  [ "$status" -eq 0 ]
+  run $GOLNDIR verify $PWD/sample-dir $targetdir
+  [ "$status" -eq 0 ]
+  [ "$output" == "" ]
+  rm $targetdir/included-file
+  touch $targetdir/dir1/extra-file
+  run $GOLNDIR verify $PWD/sample-dir $targetdir
+  [ "$status" -eq 3 ]
+  [[ "$output" == *"missing link: $targetdir/included-file -> $PWD/sample-dir/included-file"* ]]
+  [[ "$output" == *"extra file: $targetdir/dir1/extra-file"* ]]
+}
+
+@test "lndir verify errors on missing target" {
+  run $GOLNDIR verify $PWD/sample-dir missing
+  [ "$status" -eq 1 ]
+}
+
+@test "lndir -format=json writes one event per line and a summary" {
+  run $GOLNDIR -format=json -gitignore $PWD/sample-dir $targetdir
+  [ "$status" -eq 0 ]
+  echo "$output"
+  [[ "$output" == *'{"event":"dir_created","source":"'$PWD'/sample-dir/dir1","target":"'$targetdir'/dir1"}'* ]]
+  [[ "$output" == *'{"event":"link_created","source":"'$PWD'/sample-dir/included-file","target":"'$targetdir'/included-file","text":"'$PWD'/sample-dir/included-file"}'* ]]
+  [[ "$output" == *'{"event":"link_created","source":"'$PWD'/sample-dir/dir1/relative-link","target":"'$targetdir'/dir1/relative-link","text":"../included-file"}'* ]]
+  [[ "$output" == *'{"event":"skipped","source":"'$PWD'/sample-dir/ignored-file","reason":"gitignore"}'* ]]
+  [[ "$output" != *'"layer"'* ]]
+  [[ "$(echo "$output" | tail -1)" == '{"event":"summary","dirs_created":2,'* ]]
+}
+
+@test "lndir -format=json writes the layer of each link for overlays" {
+  run $GOLNDIR -format=json -overlay $PWD/sample-dir/dir1 $PWD/sample-dir $targetdir
+  [ "$status" -eq 0 ]
+  echo "$output"
+  [[ "$output" == *'{"event":"link_created","source":"'$PWD'/sample-dir/dir1/ignored-file","target":"'$targetdir'/dir1/ignored-file","text":"'$PWD'/sample-dir/dir1/ignored-file","layer":0}'* ]]
+  [[ "$output" == *'{"event":"link_created","source":"'$PWD'/sample-dir/dir1/included-file","target":"'$targetdir'/included-file","text":"'$PWD'/sample-dir/dir1/included-file","layer":1}'* ]]
+}
@@ -0,0 +1,37 @@
+package lndir
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Unlndir tears down a shadow tree that Lndir created from fromPath in toPath.  Only links that point
+// into the source tree are removed, along with directories left empty by their removal.  Real files
+// and links to anywhere else are left in place and listed in Result.Kept.  As with Lndir, a relative
+// fromPath is relative to toPath.  The source tree itself does not need to exist.
+func Unlndir(fromPath, toPath string, config Config) (*Result, error) {
+	result := &Result{}
+	linker := newDirectoryLinker(config, result)
+	linker.unlinking = true
+
+	sourcePath, err := newPath(fromPath)
+	if err != nil {
+		return result, err
+	}
+	if linker.sourceRoot, err = filepath.Abs(resolve(toPath, sourcePath)); err != nil {
+		return result, err
+	}
+
+	toDir, err := os.Stat(toPath)
+	if err != nil {
+		return result, newPathError("", toPath, err)
+	} else if !toDir.IsDir() {
+		return result, userError{&PathError{Target: toPath, Err: ErrNotDirectory}}
+	}
+	if fromDir, err := os.Stat(linker.sourceRoot); err == nil && os.SameFile(fromDir, toDir) {
+		return result, userError{&PathError{Source: fromPath, Target: toPath, Err: ErrSameDirectory}}
+	}
+
+	linker.pruneDirectory(toPath, linker.sourceRoot, nil, true)
+	return result, nil
+}
@@ -0,0 +1,54 @@
+package lndir
+
+import (
+	"context"
+	"os"
+)
+
+// Drift describes the differences between a target tree and what Lndir would produce in it.
+type Drift struct {
+	MissingLinks       []Link
+	MissingDirectories []string
+	// MismatchedLinks are links that point somewhere other than where Lndir would point them
+	MismatchedLinks []MismatchedLink
+	// StaleLinks are links into the source tree that are dangling or refer to excluded entries
+	StaleLinks []string
+	// ExtraFiles are real files in the target tree that have no counterpart in the source tree, including
+	// copies made by an earlier run in another Mode whose source has since been deleted
+	ExtraFiles []string
+	// Conflicts are entries that have the wrong type, such as directories where links should be
+	Conflicts []Conflict
+	// Errors holds failures that prevented parts of the trees from being compared
+	Errors []error
+}
+
+// IsClean returns true if no differences were found.
+func (d *Drift) IsClean() bool {
+	return len(d.MissingLinks) == 0 && len(d.MissingDirectories) == 0 && len(d.MismatchedLinks) == 0 &&
+		len(d.StaleLinks) == 0 && len(d.ExtraFiles) == 0 && len(d.Conflicts) == 0
+}
+
+// Verify compares the target tree at toPath against what Lndir would produce from fromPath with the
+// given configuration, without changing anything.  DryRun and Prune are implied and OnConflict is ignored.
+func Verify(fromPath, toPath string, config Config) (*Drift, error) {
+	config.Silent = true
+	config.DryRun = true
+	config.Prune = true
+	config.OnConflict = ConflictPolicySkip
+
+	result, err := LndirContext(context.Background(), fromPath, toPath, config)
+	drift := &Drift{
+		MissingLinks:       result.CreatedLinks,
+		MissingDirectories: result.CreatedDirectories,
+		MismatchedLinks:    result.MismatchedLinks,
+		StaleLinks:         result.RemovedLinks,
+		Conflicts:          result.Conflicts,
+		Errors:             result.Errors,
+	}
+	for _, kept := range result.Kept {
+		if info, err := os.Lstat(kept); err == nil && info.Mode()&os.ModeSymlink == 0 {
+			drift.ExtraFiles = append(drift.ExtraFiles, kept)
+		}
+	}
+	return drift, err
+}
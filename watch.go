@@ -0,0 +1,154 @@
+package lndir
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+)
+
+// Watcher keeps a shadow tree in sync with its source tree.  It builds the tree like Lndir and then
+// updates it as entries in the source tree are created, removed or renamed and as .gitignore files
+// change.  Links to entries that no longer exist are always removed, as with Config.Prune.
+//
+// On Linux, changes are picked up with inotify and only the directories they affect are updated.
+// Elsewhere, the whole tree is rescanned periodically.
+type Watcher struct {
+	// OnSync, if not nil, is called with the Result of the initial run and of every update
+	OnSync func(*Result)
+
+	fromPath, toPath string
+	config           Config
+	// linker and root are set up by the last full sync and copied for each update
+	linker *directoryLinker
+	root   *tree
+}
+
+// NewWatcher returns a Watcher for the given source and target directories, which are interpreted
+// as by Lndir.
+func NewWatcher(fromPath, toPath string, config Config) *Watcher {
+	config.Prune = true
+	return &Watcher{fromPath: fromPath, toPath: toPath, config: config}
+}
+
+// Run builds the shadow tree and keeps it in sync until ctx is done, in which case it returns nil.
+// Errors from building the tree are returned.  Errors while updating it are logged and the Watcher
+// carries on.
+func (w *Watcher) Run(ctx context.Context) error {
+	if err := w.open(ctx); err != nil {
+		return err
+	}
+	err := w.watch(ctx, w.syncTree)
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// open rereads the gitignore files and sets up the linker and tree used by later syncs.
+func (w *Watcher) open(ctx context.Context) error {
+	linker := newDirectoryLinker(w.config, &Result{})
+	root, err := linker.openTree(ctx, w.fromPath, w.toPath, w.config)
+	if err != nil {
+		return err
+	}
+	w.linker, w.root = linker, root
+	return nil
+}
+
+// syncTree syncs the whole tree.
+func (w *Watcher) syncTree(ctx context.Context) error {
+	result := &Result{}
+	linker := *w.linker
+	linker.result = result
+	err := linker.walk(ctx, w.root)
+	w.report(result)
+	return err
+}
+
+// syncAll rereads the gitignore files and syncs the whole tree.
+func (w *Watcher) syncAll(ctx context.Context) error {
+	if err := w.open(ctx); err != nil {
+		return err
+	}
+	return w.syncTree(ctx)
+}
+
+// syncDirectory syncs the entries of the source directory at the path dir, relative to the source
+// root, without revisiting subdirectories that already exist in the target.
+func (w *Watcher) syncDirectory(ctx context.Context, dir []string) error {
+	// Directories below a link in the target, such as a folded directory, are handled from the
+	// directory containing the link, and directories that have been removed from the source from
+	// the directory that contained them
+	t := w.root
+	for _, name := range dir {
+		child := t.child(name)
+		if info, err := os.Lstat(child.targetPath); err != nil || !info.IsDir() {
+			break
+		}
+		if info, err := os.Stat(child.sourceName); err != nil || !info.IsDir() {
+			break
+		}
+		t = child
+	}
+
+	var err error
+	if t.sourceDir, err = os.Stat(t.sourceName); err != nil {
+		return newPathError(t.sourcePath.String(), "", err)
+	}
+	if t.targetDir, err = os.Stat(t.targetPath); err != nil {
+		return newPathError("", t.targetPath, err)
+	}
+
+	result := &Result{}
+	linker := *w.linker
+	linker.result = result
+	linker.shallow = true
+	err = linker.walk(ctx, t)
+	w.report(result)
+	return err
+}
+
+func (w *Watcher) report(result *Result) {
+	if w.OnSync != nil {
+		w.OnSync(result)
+	}
+}
+
+// logUpdateError logs an error that stopped an update.
+func (w *Watcher) logUpdateError(err error) {
+	w.linker.logger.Println(err)
+}
+
+// watchedDirectories calls fn with the tree and relative path of every source directory below t,
+// including t itself, whose contents are linked.
+func (w *Watcher) watchedDirectories(t *tree, dir []string, fn func(t *tree, dir []string)) {
+	fn(t, dir)
+	f, err := os.Open(t.sourceName)
+	if err != nil {
+		return
+	}
+	names, _ := f.Readdirnames(0)
+	f.Close()
+	for _, name := range names {
+		if w.isLinkedDirectory(t, name) {
+			w.watchedDirectories(t.child(name), append(dir[:len(dir):len(dir)], name), fn)
+		}
+	}
+}
+
+// isLinkedDirectory returns true if the entry name in the source directory of t is a directory
+// whose contents are linked.
+func (w *Watcher) isLinkedDirectory(t *tree, name string) bool {
+	info, err := os.Lstat(join(t.sourceName, name))
+	if err != nil || !info.IsDir() {
+		return false
+	}
+	sourcePath := append(t.sourcePath[:len(t.sourcePath):len(t.sourcePath)], name)
+	return w.linker.skipReason(sourcePath, info, t.depth) == ""
+}
+
+// isGitignore returns true if name is a file that affects which entries are skipped.
+func (w *Watcher) isGitignore(name string) bool {
+	base := filepath.Base(name)
+	return (w.config.UseGitignore && base == ".gitignore") || (!w.config.NoIgnoreFile && base == ignoreFileName(w.config))
+}
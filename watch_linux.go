@@ -0,0 +1,153 @@
+package lndir
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	// watchMask selects the inotify events that can require changes to the target tree
+	watchMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_CLOSE_WRITE | syscall.IN_ONLYDIR
+	// settleTime is how long to wait for more events before updating the tree, so that bursts of
+	// changes are handled together
+	settleTime = 100 * time.Millisecond
+)
+
+// watch calls initialSync once the source directories are being watched, so that no changes made
+// while it runs are missed.
+func (w *Watcher) watch(ctx context.Context, initialSync func(context.Context) error) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_NONBLOCK | syscall.IN_CLOEXEC)
+	if err != nil {
+		return os.NewSyscallError("inotify_init1", err)
+	}
+	// A non-blocking descriptor uses the runtime poller, so closing it interrupts Read
+	events := os.NewFile(uintptr(fd), "inotify")
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		events.Close()
+	}()
+
+	// watches maps watch descriptors to source directories, relative to the source root
+	watches := map[int32][]string{}
+	addWatches := func(t *tree, dir []string) {
+		w.watchedDirectories(t, dir, func(t *tree, dir []string) {
+			if wd, err := syscall.InotifyAddWatch(fd, t.sourceName, watchMask); err == nil {
+				watches[int32(wd)] = dir
+			}
+		})
+	}
+	rewatch := func() {
+		old := watches
+		watches = map[int32][]string{}
+		addWatches(w.root, nil)
+		for wd := range old {
+			if _, ok := watches[wd]; !ok {
+				syscall.InotifyRmWatch(fd, uint32(wd))
+			}
+		}
+	}
+	rewatch()
+	if err := initialSync(ctx); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 64*1024)
+	for {
+		full, moved := false, false
+		dirty := map[string][]string{}
+		var created [][]string
+
+		events.SetReadDeadline(time.Time{})
+		for {
+			n, err := events.Read(buf)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			} else if err != nil {
+				return err
+			}
+			for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+				event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+				name := strings.TrimRight(string(buf[offset+syscall.SizeofInotifyEvent:offset+syscall.SizeofInotifyEvent+int(event.Len)]), "\x00")
+				offset += syscall.SizeofInotifyEvent + int(event.Len)
+
+				if event.Mask&syscall.IN_Q_OVERFLOW != 0 {
+					full = true
+					continue
+				}
+				if event.Mask&syscall.IN_IGNORED != 0 {
+					delete(watches, event.Wd)
+					continue
+				}
+				dir, ok := watches[event.Wd]
+				if !ok {
+					continue
+				}
+				if w.isGitignore(name) {
+					full = true
+				}
+				if event.Mask&syscall.IN_ISDIR != 0 {
+					if event.Mask&(syscall.IN_MOVED_FROM|syscall.IN_MOVED_TO) != 0 {
+						moved = true
+					} else if event.Mask&syscall.IN_CREATE != 0 {
+						created = append(created, append(dir[:len(dir):len(dir)], name))
+					}
+				}
+				dirty[strings.Join(dir, "/")] = dir
+			}
+			events.SetReadDeadline(time.Now().Add(settleTime))
+		}
+
+		if full {
+			if err := w.open(ctx); err != nil {
+				w.logUpdateError(err)
+				continue
+			}
+			rewatch()
+			if err := w.syncTree(ctx); err != nil {
+				w.logUpdateError(err)
+			}
+			continue
+		}
+
+		// Watch new directories before linking their contents, so that nothing created in them in
+		// the meantime is missed
+		if moved {
+			rewatch()
+		} else {
+			for _, dir := range created {
+				parent := w.root
+				for _, name := range dir[:len(dir)-1] {
+					parent = parent.child(name)
+				}
+				if name := dir[len(dir)-1]; w.isLinkedDirectory(parent, name) {
+					addWatches(parent.child(name), dir)
+				}
+			}
+		}
+
+		keys := make([]string, 0, len(dirty))
+		for key := range dirty {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if err := w.syncDirectory(ctx, dirty[key]); err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				w.logUpdateError(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,30 @@
+//go:build !linux
+// +build !linux
+
+package lndir
+
+import (
+	"context"
+	"time"
+)
+
+// pollInterval is how often the source tree is rescanned on platforms without inotify
+const pollInterval = 2 * time.Second
+
+func (w *Watcher) watch(ctx context.Context, initialSync func(context.Context) error) error {
+	if err := initialSync(ctx); err != nil {
+		return err
+	}
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if err := w.syncAll(ctx); err != nil {
+				w.logUpdateError(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package lndir
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// eventually waits for condition to become true
+func eventually(t *testing.T, condition func() bool, message string) {
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		if condition() {
+			return
+		}
+	}
+	t.Error(message)
+}
+
+func isLinkTo(name, text string) func() bool {
+	return func() bool {
+		link, err := os.Readlink(name)
+		return err == nil && link == text
+	}
+}
+
+func isMissing(name string) func() bool {
+	return func() bool {
+		_, err := os.Lstat(name)
+		return os.IsNotExist(err)
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	source := makeTree(t, "a", "dir1/b", ".gitignore")
+	defer os.RemoveAll(source)
+	target := makeTree(t)
+	defer os.RemoveAll(target)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	synced := make(chan struct{}, 1)
+	watcher := NewWatcher(source, target, Config{Silent: true, UseGitignore: true, Logger: discardLogger{}})
+	watcher.OnSync = func(*Result) {
+		select {
+		case synced <- struct{}{}:
+		default:
+		}
+	}
+	done := make(chan error)
+	go func() { done <- watcher.Run(ctx) }()
+	select {
+	case <-synced:
+	case err := <-done:
+		t.Fatalf("watcher stopped before the initial sync: %v", err)
+	case <-time.After(10 * time.Second):
+		cancel()
+		t.Fatal("initial sync did not finish")
+	}
+	assert.True(t, isLinkTo(filepath.Join(target, "dir1", "b"), filepath.Join(source, "dir1", "b"))())
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(source, "dir1", "c"), nil, 0666))
+	eventually(t, isLinkTo(filepath.Join(target, "dir1", "c"), filepath.Join(source, "dir1", "c")), "new file was not linked")
+
+	assert.NoError(t, os.MkdirAll(filepath.Join(source, "dir2", "sub"), 0777))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(source, "dir2", "sub", "d"), nil, 0666))
+	eventually(t, isLinkTo(filepath.Join(target, "dir2", "sub", "d"), filepath.Join(source, "dir2", "sub", "d")), "new directory was not linked")
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(source, "dir2", "sub", "e"), nil, 0666))
+	eventually(t, isLinkTo(filepath.Join(target, "dir2", "sub", "e"), filepath.Join(source, "dir2", "sub", "e")), "file in new directory was not linked")
+
+	assert.NoError(t, os.Remove(filepath.Join(source, "a")))
+	eventually(t, isMissing(filepath.Join(target, "a")), "link to removed file was not removed")
+	assert.NoError(t, os.RemoveAll(filepath.Join(source, "dir2")))
+	eventually(t, isMissing(filepath.Join(target, "dir2")), "removed directory was not removed")
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(source, ".gitignore"), []byte("b\n"), 0666))
+	eventually(t, isMissing(filepath.Join(target, "dir1", "b")), "link to newly ignored file was not removed")
+
+	cancel()
+	assert.NoError(t, <-done)
+}
+
+func TestWatcherPicksUpChangesDuringInitialSync(t *testing.T) {
+	source := makeTree(t, "a")
+	defer os.RemoveAll(source)
+	target := makeTree(t)
+	defer os.RemoveAll(target)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	watcher := NewWatcher(source, target, Config{Silent: true, Logger: discardLogger{}})
+	done := make(chan error)
+	go func() { done <- watcher.Run(ctx) }()
+
+	// Change the source without waiting for the initial sync, so that the changes race with it
+	assert.NoError(t, os.MkdirAll(filepath.Join(source, "dir1", "sub"), 0777))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(source, "dir1", "sub", "b"), nil, 0666))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(source, "c"), nil, 0666))
+	eventually(t, isLinkTo(filepath.Join(target, "a"), filepath.Join(source, "a")), "existing file was not linked")
+	eventually(t, isLinkTo(filepath.Join(target, "dir1", "sub", "b"), filepath.Join(source, "dir1", "sub", "b")), "file in new directory was not linked")
+	eventually(t, isLinkTo(filepath.Join(target, "c"), filepath.Join(source, "c")), "new file was not linked")
+
+	cancel()
+	assert.NoError(t, <-done)
+}